@@ -0,0 +1,264 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	massDeleteAlerted = make(map[string]time.Time) // 用户上次批量删除告警的时间，同一窗口内只告警一次
+	muActivity        sync.Mutex
+)
+
+// userActivity 用户一天的操作汇总
+type userActivity struct {
+	OpUser       string   `json:"opUser"`
+	Total        int      `json:"total"`
+	Success      int      `json:"success"`
+	Failed       int      `json:"failed"` // 包含回滚
+	AddedIPs     int      `json:"addedIPs"`
+	RemovedIPs   int      `json:"removedIPs"`
+	Merchants    []string `json:"merchants"`
+	OffHours     int      `json:"offHours"`     // 非工作时间的操作次数
+	MassDelete   bool     `json:"massDelete"`   // 是否出现批量删除
+	NewMerchants []string `json:"newMerchants"` // 首次操作的商户
+}
+
+// isOffHours 是否在工作时间之外
+func isOffHours(t time.Time) bool {
+	cfg := AppConfig.Activity
+	t = t.In(time.Local)
+	if cfg.WeekendOff && (t.Weekday() == time.Saturday || t.Weekday() == time.Sunday) {
+		return true
+	}
+	if cfg.WorkStartHour == cfg.WorkEndHour {
+		return false
+	}
+
+	hour := t.Hour()
+	if cfg.WorkStartHour < cfg.WorkEndHour {
+		return hour < cfg.WorkStartHour || hour >= cfg.WorkEndHour
+	}
+	// 跨零点的工作时间
+	return hour < cfg.WorkStartHour && hour >= cfg.WorkEndHour
+}
+
+// massDeleteWindow 批量删除的时间窗口
+func massDeleteWindow() time.Duration {
+	return time.Duration(AppConfig.Activity.MassDeleteMinutes) * time.Minute
+}
+
+// deletedIPCount 用户在时间段内成功删除的IP数，不含到期删除
+func deletedIPCount(opUser string, since time.Time) (int, error) {
+	var rows []WhitelistLog
+	err := DB.Select("changed_ips").Where("op_user = ? AND act = ? AND status = ? AND source <> ? AND created_at >= ?", opUser, "del", LogStatusSuccess, SourceExpire, since).Find(&rows).Error
+	count := 0
+	for _, row := range rows {
+		count += len(splitIPs(row.ChangedIPs))
+	}
+	return count, err
+}
+
+// merchantTouchedBefore 用户在 before 之前是否成功操作过该商户，日志归档后按版本记录判断，版本记录不归档
+func merchantTouchedBefore(opUser, merchantName string, before time.Time) (bool, error) {
+	var count int64
+	err := DB.Model(&WhitelistLog{}).Where("op_user = ? AND merchant_name = ? AND status = ? AND created_at < ?", opUser, merchantName, LogStatusSuccess, before).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	err = DB.Model(&WhitelistVersion{}).Where("op_user = ? AND merchant_name = ? AND created_at < ?", opUser, merchantName, before).Count(&count).Error
+	return count > 0, err
+}
+
+// checkActivity 成功修改白名单后检查是否需要告警，changedAt 为写入本次日志之前的时间，批量任务的子任务由任务完成时统一检查首次操作
+func checkActivity(whitelistLog WhitelistLog, req Request, changedAt time.Time) {
+	// 到期删除由系统执行，不是用户的操作
+	if whitelistLog.Source == SourceExpire {
+		return
+	}
+
+	cfg := AppConfig.Activity
+	now := time.Now()
+	// 计划变更按提交时间判断，批量执行的变更不计入批量删除
+	scheduled := !req.HeldAt.IsZero()
+	submittedAt := now
+	if scheduled {
+		submittedAt = req.HeldAt
+	}
+	event := NotifyEvent{
+		Country:  whitelistLog.Country,
+		Merchant: whitelistLog.MerchantName,
+		IPs:      splitIPs(whitelistLog.ChangedIPs),
+		Action:   whitelistLog.Act,
+		OpUser:   whitelistLog.OpUser,
+		Time:     submittedAt.In(time.Local).Format("2006-01-02 15:04:05"),
+	}
+
+	if whitelistLog.Act == "del" && cfg.MassDeleteIPs > 0 && !scheduled {
+		window := massDeleteWindow()
+		count, err := deletedIPCount(whitelistLog.OpUser, now.Add(-window))
+		if err != nil {
+			log.Printf("统计删除IP数失败: %v", err)
+		} else if count >= cfg.MassDeleteIPs {
+			muActivity.Lock()
+			alert := now.Sub(massDeleteAlerted[whitelistLog.OpUser]) >= window
+			if alert {
+				massDeleteAlerted[whitelistLog.OpUser] = now
+			}
+			muActivity.Unlock()
+
+			if alert {
+				massEvent := event
+				massEvent.Type, massEvent.Count, massEvent.Minutes = EventMassDelete, count, cfg.MassDeleteMinutes
+				notify(massEvent)
+			}
+		}
+	}
+
+	if isOffHours(submittedAt) {
+		offEvent := event
+		offEvent.Type = EventOffHours
+		notify(offEvent)
+	}
+
+	if cfg.NewMerchant && req.JobID == 0 {
+		// 本次操作之前没有其他成功记录即为首次
+		touched, err := merchantTouchedBefore(whitelistLog.OpUser, whitelistLog.MerchantName, changedAt)
+		if err != nil {
+			log.Printf("查询用户操作记录失败: %v", err)
+		} else if !touched {
+			newEvent := event
+			newEvent.Type = EventNewMerchant
+			notify(newEvent)
+		}
+	}
+}
+
+// checkJobNewMerchants 批量任务完成后检查首次操作的商户，一个任务只告警一次
+func checkJobNewMerchants(job WhitelistJob) {
+	if !AppConfig.Activity.NewMerchant || job.Source == SourceExpire {
+		return
+	}
+
+	merchants := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, sub := range job.SubJobs {
+		if sub.Status != LogStatusSuccess || seen[sub.MerchantName] {
+			continue
+		}
+		seen[sub.MerchantName] = true
+		// 同一任务的其他子任务不算之前的操作
+		touched, err := merchantTouchedBefore(job.OpUser, sub.MerchantName, job.CreatedAt)
+		if err != nil {
+			log.Printf("查询用户操作记录失败: %v", err)
+		} else if !touched {
+			merchants = append(merchants, sub.MerchantName)
+		}
+	}
+	if len(merchants) == 0 {
+		return
+	}
+	notify(NotifyEvent{
+		Type:     EventNewMerchant,
+		Country:  job.Country,
+		Merchant: strings.Join(merchants, ","),
+		IPs:      splitIPs(job.IP),
+		Action:   job.Action,
+		OpUser:   job.OpUser,
+		Time:     job.CreatedAt.In(time.Local).Format("2006-01-02 15:04:05"),
+	})
+}
+
+// activityReport 某天各用户的操作汇总，opUser 为空时统计所有用户
+func activityReport(day time.Time, opUser string) ([]userActivity, error) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	query := DB.Where("created_at >= ? AND created_at < ?", start, start.AddDate(0, 0, 1)).Order("id")
+	if opUser != "" {
+		query = query.Where("op_user = ?", opUser)
+	}
+	var logs []WhitelistLog
+	if err := query.Find(&logs).Error; err != nil {
+		return nil, err
+	}
+
+	type deletion struct {
+		at    time.Time
+		count int
+	}
+	reports := make(map[string]*userActivity)
+	merchants := make(map[string]map[string]bool)
+	deletions := make(map[string][]deletion)
+	for _, l := range logs {
+		report, ok := reports[l.OpUser]
+		if !ok {
+			report = &userActivity{OpUser: l.OpUser, Merchants: []string{}, NewMerchants: []string{}}
+			reports[l.OpUser] = report
+			merchants[l.OpUser] = make(map[string]bool)
+		}
+
+		report.Total++
+		// 到期删除由系统执行，不计入非工作时间和批量删除
+		system := l.Source == SourceExpire
+		if isOffHours(l.CreatedAt) && !system {
+			report.OffHours++
+		}
+		switch l.Status {
+		case LogStatusFailed, LogStatusRolledBack:
+			report.Failed++
+		case LogStatusSuccess:
+			report.Success++
+			changed := len(splitIPs(l.ChangedIPs))
+			if l.Act == "add" {
+				report.AddedIPs += changed
+			} else {
+				report.RemovedIPs += changed
+				if !system {
+					deletions[l.OpUser] = append(deletions[l.OpUser], deletion{l.CreatedAt, changed})
+				}
+			}
+			if !merchants[l.OpUser][l.MerchantName] {
+				merchants[l.OpUser][l.MerchantName] = true
+				report.Merchants = append(report.Merchants, l.MerchantName)
+			}
+		}
+	}
+
+	result := make([]userActivity, 0, len(reports))
+	for user, report := range reports {
+		// 滑动窗口内删除的IP数是否达到阈值
+		if threshold := AppConfig.Activity.MassDeleteIPs; threshold > 0 {
+			list, sum, i := deletions[user], 0, 0
+			for _, d := range list {
+				sum += d.count
+				for d.at.Sub(list[i].at) > massDeleteWindow() {
+					sum -= list[i].count
+					i++
+				}
+				if sum >= threshold {
+					report.MassDelete = true
+					break
+				}
+			}
+		}
+
+		for _, merchantName := range report.Merchants {
+			touched, err := merchantTouchedBefore(user, merchantName, start)
+			if err != nil {
+				return nil, err
+			}
+			if !touched {
+				report.NewMerchants = append(report.NewMerchants, merchantName)
+			}
+		}
+		result = append(result, *report)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Total > result[j].Total || (result[i].Total == result[j].Total && result[i].OpUser < result[j].OpUser)
+	})
+	return result, nil
+}
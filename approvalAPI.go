@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// requestApproval 保存需要审批的请求
+func requestApproval(req Request, reason string) (WhitelistApproval, error) {
+	approval := WhitelistApproval{
+		MerchantName: req.WhiteList.MerchantName,
+		Country:      req.WhiteList.Country,
+		IP:           req.WhiteList.IP,
+		Action:       req.Action,
+		OpUser:       req.WhiteList.OpUser,
+		Source:       req.Source,
+		ClientIP:     req.ClientIP,
+		Reason:       reason,
+		Status:       ApprovalPending,
+		Metas:        req.Metas,
+	}
+	return approval, DB.Create(&approval).Error
+}
+
+// whitelistApprovals 审批列表，可按 status 过滤
+func whitelistApprovals(c *gin.Context) {
+	query := DB.Order("id DESC")
+	if status := c.DefaultQuery("status", ""); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var approvals []WhitelistApproval
+	if err := query.Find(&approvals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": approvals})
+}
+
+// whitelistApprove 审批通过后进入正常的处理队列
+func whitelistApprove(c *gin.Context) {
+	decideApproval(c, ApprovalApproved)
+}
+
+// whitelistReject 拒绝审批
+func whitelistReject(c *gin.Context) {
+	decideApproval(c, ApprovalRejected)
+}
+
+// decideApproval 审批人需具备审批角色且不能审批自己的请求
+func decideApproval(c *gin.Context, status string) {
+	var body struct {
+		ID     uint   `json:"id" binding:"required"`
+		OpUser string `json:"opUser" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "格式错误"})
+		return
+	}
+
+	var user User
+	if err := DB.Where("username = ?", body.OpUser).First(&user).Error; err != nil || !contains(AppConfig.GeoIP.ApproveRoles, user.Role) {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "没有审批权限"})
+		return
+	}
+
+	var approval WhitelistApproval
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND status = ?", body.ID, ApprovalPending).First(&approval).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("审批不存在或已处理")
+			}
+			return err
+		}
+		if approval.OpUser == body.OpUser {
+			return fmt.Errorf("不能审批自己的请求")
+		}
+
+		now := time.Now()
+		approval.Status, approval.Approver, approval.ApprovedAt = status, body.OpUser, &now
+		return tx.Save(&approval).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": err.Error()})
+		return
+	}
+
+	if status == ApprovalApproved {
+		go whitelistModify(Request{
+			WhiteList: WhiteList{MerchantName: approval.MerchantName, Country: approval.Country, IP: approval.IP, OpUser: approval.OpUser},
+			Action:    approval.Action,
+			Source:    SourceApprove,
+			ClientIP:  approval.ClientIP,
+			Metas:     approval.Metas,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "message": "审批完成", "data": approval})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LogArchive 按月归档的日志文件
+type LogArchive struct {
+	gorm.Model
+	Month    string `json:"month" gorm:"size:7;uniqueIndex"` // 2006-01
+	Path     string `json:"path"`
+	Count    int64  `json:"count"`
+	FirstID  uint   `json:"firstId"`
+	LastID   uint   `json:"lastId" gorm:"index"`
+	LastHash string `json:"lastHash" gorm:"size:64"` // 本月最后一条日志的哈希
+	SHA256   string `json:"sha256" gorm:"size:64"`   // 归档文件的校验和
+}
+
+// monthArchive 一次归档中某个月的写入状态
+type monthArchive struct {
+	file     *os.File
+	gz       *gzip.Writer
+	enc      *json.Encoder
+	size     int64 // 写入前的文件大小，失败时回退
+	count    int64
+	firstID  uint
+	lastID   uint
+	lastHash string
+}
+
+// archivePath 月份对应的归档文件
+func archivePath(month string) string {
+	return filepath.Join(AppConfig.Retention.ArchiveDir, fmt.Sprintf("whitelist_logs-%s.ndjson.gz", month))
+}
+
+// openMonthArchive 以追加方式打开归档，每次归档写入一个新的 gzip 成员
+func openMonthArchive(month string) (*monthArchive, error) {
+	f, err := os.OpenFile(archivePath(month), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &monthArchive{file: f, gz: gz, enc: json.NewEncoder(gz), size: info.Size()}, nil
+}
+
+// flush 写完本次的 gzip 成员并落盘，之后才能计算校验和
+func (a *monthArchive) flush() error {
+	if err := a.gz.Close(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// close 关闭归档，failed 时回退本次写入的内容，成功时需先 flush
+func (a *monthArchive) close(failed bool) error {
+	if failed {
+		_ = a.file.Truncate(a.size)
+	}
+	return a.file.Close()
+}
+
+// fileSHA256 计算文件的校验和
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// archiveAnchor 最后归档的日志，数据库中剩余日志的哈希链从它开始
+func archiveAnchor(tx *gorm.DB) (LogArchive, error) {
+	var anchor LogArchive
+	err := tx.Order("last_id DESC").Limit(1).Find(&anchor).Error
+	return anchor, err
+}
+
+// archiveWhitelistLogs 将超过保留天数的日志移到按月的 gzip NDJSON 归档，返回归档条数
+func archiveWhitelistLogs() (int64, error) {
+	days := AppConfig.Retention.Days
+	if days <= 0 {
+		return 0, nil
+	}
+
+	muLogChain.Lock()
+	defer muLogChain.Unlock()
+
+	// 归档 id 连续的最早一段日志，保证剩余日志的哈希链完整
+	var maxID sql.NullInt64
+	cutoff := time.Now().AddDate(0, 0, -days)
+	if err := DB.Unscoped().Model(&WhitelistLog{}).Where("created_at < ?", cutoff).Select("MAX(id)").Scan(&maxID).Error; err != nil {
+		return 0, err
+	}
+	if !maxID.Valid {
+		return 0, nil
+	}
+
+	if err := os.MkdirAll(AppConfig.Retention.ArchiveDir, 0755); err != nil {
+		return 0, err
+	}
+
+	months := make(map[string]*monthArchive)
+	var total int64
+	var rows []WhitelistLog
+	err := DB.Unscoped().Where("id <= ?", maxID.Int64).FindInBatches(&rows, 500, func(tx *gorm.DB, batch int) error {
+		for _, row := range rows {
+			month := row.CreatedAt.In(time.Local).Format("2006-01")
+			a, ok := months[month]
+			if !ok {
+				var err error
+				if a, err = openMonthArchive(month); err != nil {
+					return err
+				}
+				months[month] = a
+				a.firstID = row.ID
+			}
+			if err := a.enc.Encode(row); err != nil {
+				return err
+			}
+			a.count++
+			a.lastID, a.lastHash = row.ID, row.Hash
+			total++
+		}
+		return nil
+	}).Error
+
+	for _, a := range months {
+		if err == nil {
+			err = a.flush()
+		}
+	}
+	if err != nil {
+		closeMonthArchives(months, true)
+		return 0, fmt.Errorf("写入归档失败: %w", err)
+	}
+
+	// 数据库事务失败时回退归档文件，避免下次重复归档
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		for month, a := range months {
+			var archive LogArchive
+			if err := tx.Where("month = ?", month).Limit(1).Find(&archive).Error; err != nil {
+				return err
+			}
+			if archive.ID == 0 || a.firstID < archive.FirstID {
+				archive.FirstID = a.firstID
+			}
+			if a.lastID > archive.LastID {
+				archive.LastID, archive.LastHash = a.lastID, a.lastHash
+			}
+			archive.Month = month
+			archive.Path = archivePath(month)
+			archive.Count += a.count
+
+			sum, err := fileSHA256(archive.Path)
+			if err != nil {
+				return err
+			}
+			archive.SHA256 = sum
+			if err := tx.Save(&archive).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Where("id <= ?", maxID.Int64).Delete(&WhitelistLog{}).Error
+	})
+	if closeErr := closeMonthArchives(months, err != nil); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// closeMonthArchives 关闭本次写入的所有归档，返回第一个错误
+func closeMonthArchives(months map[string]*monthArchive, failed bool) error {
+	var err error
+	for _, a := range months {
+		if closeErr := a.close(failed); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// scanArchives 按月份顺序遍历所有归档的日志
+func scanArchives(fn func(l WhitelistLog) error) error {
+	var archives []LogArchive
+	if err := DB.Order("month").Find(&archives).Error; err != nil {
+		return err
+	}
+
+	for _, archive := range archives {
+		if err := scanArchiveFile(archive.Path, fn); err != nil {
+			return fmt.Errorf("读取归档 %s 失败: %w", archive.Path, err)
+		}
+	}
+	return nil
+}
+
+// scanArchiveFile 遍历单个归档文件，gzip.Reader 默认读取所有成员
+func scanArchiveFile(path string, fn func(l WhitelistLog) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var l WhitelistLog
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return err
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// runLogRetention 定期执行日志归档
+func runLogRetention() {
+	for {
+		if total, err := archiveWhitelistLogs(); err != nil {
+			log.Printf("归档日志失败: %v", err)
+		} else if total > 0 {
+			log.Printf("已归档 %d 条日志", total)
+		}
+		time.Sleep(time.Duration(AppConfig.Retention.IntervalHours) * time.Hour)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// muLogChain 保证日志按顺序加入哈希链
+var muLogChain sync.Mutex
+
+// errChainBroken 校验遇到断链时用于提前结束遍历
+var errChainBroken = errors.New("哈希链断裂")
+
+// logChainContent 参与哈希计算的日志内容，字段顺序固定
+type logChainContent struct {
+	CreatedAt    int64  `json:"createdAt"`
+	IP           string `json:"ip"`
+	MerchantName string `json:"merchantName"`
+	Act          string `json:"act"`
+	OpUser       string `json:"opUser"`
+	Country      string `json:"country"`
+	Status       string `json:"status"`
+	ChangedIPs   string `json:"changedIPs"`
+	BeforeIPs    string `json:"beforeIPs"`
+	AfterIPs     string `json:"afterIPs"`
+	ExitCodes    string `json:"exitCodes"`
+	Output       string `json:"output"`
+	Message      string `json:"message"`
+	Source       string `json:"source"`
+	ClientIP     string `json:"clientIP"`
+	RetryOf      uint   `json:"retryOf,omitempty"` // 为空时不参与，之前的日志哈希不变
+}
+
+// logChainHash 计算日志的哈希: sha256(上一条哈希 + 规范化的日志内容)
+func logChainHash(l *WhitelistLog) string {
+	content := logChainContent{
+		CreatedAt:    l.CreatedAt.UnixMicro(),
+		IP:           l.IP,
+		MerchantName: l.MerchantName,
+		Act:          l.Act,
+		OpUser:       l.OpUser,
+		Country:      l.Country,
+		Status:       l.Status,
+		ChangedIPs:   l.ChangedIPs,
+		BeforeIPs:    l.BeforeIPs,
+		AfterIPs:     l.AfterIPs,
+		ExitCodes:    l.ExitCodes,
+		Output:       l.Output,
+		Message:      l.Message,
+		Source:       l.Source,
+		ClientIP:     l.ClientIP,
+		RetryOf:      l.RetryOf,
+	}
+	data, _ := json.Marshal(content)
+	sum := sha256.Sum256(append([]byte(l.PrevHash), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// lastLogHash 哈希链末端的哈希，日志全部归档时取最后归档的哈希
+func lastLogHash(tx *gorm.DB) (string, error) {
+	var last WhitelistLog
+	err := tx.Unscoped().Select("hash").Where("hash <> ''").Order("id DESC").First(&last).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		anchor, err := archiveAnchor(tx)
+		return anchor.LastHash, err
+	}
+	return last.Hash, err
+}
+
+// createWhitelistLog 写入操作日志
+func createWhitelistLog(tx *gorm.DB, whitelistLog *WhitelistLog) error {
+	muLogChain.Lock()
+	defer muLogChain.Unlock()
+
+	return appendWhitelistLog(tx, whitelistLog)
+}
+
+// appendWhitelistLog 写入操作日志并加入哈希链，调用方需持有 muLogChain
+func appendWhitelistLog(tx *gorm.DB, whitelistLog *WhitelistLog) error {
+	// 数据库中保存到微秒，保证读回后哈希一致
+	whitelistLog.CreatedAt = time.Now().In(time.Local).Truncate(time.Microsecond)
+
+	prevHash, err := lastLogHash(tx)
+	if err != nil {
+		return err
+	}
+	whitelistLog.PrevHash = prevHash
+	whitelistLog.Hash = logChainHash(whitelistLog)
+	return tx.Create(whitelistLog).Error
+}
+
+// LogChainSeal 为升级前的日志补齐哈希链的迁移记录，存在时不再补齐
+type LogChainSeal struct {
+	gorm.Model
+	LastID uint  `json:"lastId"` // 补齐的最后一条日志
+	Count  int64 `json:"count"`
+}
+
+// sealWhitelistLogs 为升级前没有哈希的日志补齐哈希链，只执行一次，之后缺少哈希的日志视为断链
+func sealWhitelistLogs() error {
+	muLogChain.Lock()
+	defer muLogChain.Unlock()
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var sealed int64
+		if err := tx.Model(&LogChainSeal{}).Count(&sealed).Error; err != nil {
+			return err
+		}
+		if sealed > 0 {
+			return nil
+		}
+
+		// 只补齐第一条有哈希的日志之前的历史日志
+		query := tx.Unscoped().Where("hash IS NULL OR hash = ''")
+		var first WhitelistLog
+		if err := tx.Unscoped().Select("id").Where("hash <> ''").Order("id").Limit(1).Find(&first).Error; err != nil {
+			return err
+		}
+		if first.ID != 0 {
+			query = query.Where("id < ?", first.ID)
+		}
+		var rows []WhitelistLog
+		if err := query.Order("id").Find(&rows).Error; err != nil {
+			return err
+		}
+
+		anchor, err := archiveAnchor(tx)
+		if err != nil {
+			return err
+		}
+		prevHash := anchor.LastHash
+		seal := LogChainSeal{}
+		for _, row := range rows {
+			row.PrevHash = prevHash
+			row.Hash = logChainHash(&row)
+			if err := tx.Unscoped().Model(&WhitelistLog{}).Where("id = ?", row.ID).UpdateColumns(map[string]interface{}{
+				"prev_hash": row.PrevHash,
+				"hash":      row.Hash,
+			}).Error; err != nil {
+				return err
+			}
+			prevHash = row.Hash
+			seal.LastID = row.ID
+			seal.Count++
+		}
+		return tx.Create(&seal).Error
+	})
+}
+
+// logChainReport 哈希链校验结果
+type logChainReport struct {
+	Valid    bool   `json:"valid"`
+	Checked  int64  `json:"checked"`
+	Archived int64  `json:"archived"` // 已归档的日志条数
+	BrokenAt uint   `json:"brokenAt,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	LastID   uint   `json:"lastId"`
+	LastHash string `json:"lastHash"`
+}
+
+// verifyLogChain 校验哈希链，先校验归档文件的校验和并重新计算归档日志的哈希，再接着校验数据库中的日志
+func verifyLogChain() (logChainReport, error) {
+	report := logChainReport{Valid: true}
+	prevHash := ""
+
+	// checkRow 校验一条日志是否接在上一条之后
+	checkRow := func(row WhitelistLog) error {
+		if row.Hash == "" {
+			report.Valid, report.BrokenAt = false, row.ID
+			report.Reason = "缺少哈希，日志可能被修改"
+			return errChainBroken
+		}
+		if row.PrevHash != prevHash {
+			report.Valid, report.BrokenAt = false, row.ID
+			report.Reason = "上一条哈希不匹配，日志可能被删除或插入"
+			return errChainBroken
+		}
+		if logChainHash(&row) != row.Hash {
+			report.Valid, report.BrokenAt = false, row.ID
+			report.Reason = "内容哈希不匹配，日志可能被修改"
+			return errChainBroken
+		}
+		prevHash = row.Hash
+		report.LastID, report.LastHash = row.ID, row.Hash
+		return nil
+	}
+
+	// 归档按 id 顺序写入，按第一条日志排序即为哈希链顺序
+	var archives []LogArchive
+	if err := DB.Order("first_id").Find(&archives).Error; err != nil {
+		return report, err
+	}
+	for _, archive := range archives {
+		sum, err := fileSHA256(archive.Path)
+		if err != nil {
+			report.Valid, report.BrokenAt = false, archive.FirstID
+			report.Reason = fmt.Sprintf("读取归档 %s 失败: %v", archive.Path, err)
+			return report, nil
+		}
+		if sum != archive.SHA256 {
+			report.Valid, report.BrokenAt = false, archive.FirstID
+			report.Reason = fmt.Sprintf("归档 %s 校验和不匹配，归档可能被修改", archive.Path)
+			return report, nil
+		}
+
+		var count int64
+		err = scanArchiveFile(archive.Path, func(l WhitelistLog) error {
+			count++
+			return checkRow(l)
+		})
+		if errors.Is(err, errChainBroken) {
+			return report, nil
+		}
+		if err != nil {
+			report.Valid, report.BrokenAt = false, archive.FirstID
+			report.Reason = fmt.Sprintf("读取归档 %s 失败: %v", archive.Path, err)
+			return report, nil
+		}
+		if count != archive.Count || prevHash != archive.LastHash {
+			report.Valid, report.BrokenAt = false, archive.LastID
+			report.Reason = fmt.Sprintf("归档 %s 的日志数量或末尾哈希与归档记录不一致", archive.Path)
+			return report, nil
+		}
+		report.Archived += count
+	}
+
+	var rows []WhitelistLog
+	err := DB.Unscoped().Order("id").FindInBatches(&rows, 500, func(tx *gorm.DB, batch int) error {
+		for _, row := range rows {
+			if err := checkRow(row); err != nil {
+				return err
+			}
+			report.Checked++
+		}
+		return nil
+	}).Error
+	if err != nil && !errors.Is(err, errChainBroken) {
+		return report, err
+	}
+	return report, nil
+}
+
+// logCheckpoint 哈希链的签名检查点，用于发现末尾日志被删除
+type logCheckpoint struct {
+	LastID    uint      `json:"lastId"`
+	LastHash  string    `json:"lastHash"`
+	Count     int64     `json:"count"`
+	CreatedAt time.Time `json:"createdAt"`
+	Signature string    `json:"signature"`
+}
+
+// signingPayload 签名的内容
+func (c logCheckpoint) signingPayload() []byte {
+	return []byte(fmt.Sprintf("%d|%s|%d|%d", c.LastID, c.LastHash, c.Count, c.CreatedAt.Unix()))
+}
+
+// newLogCheckpoint 校验哈希链并生成签名检查点
+func newLogCheckpoint(key ed25519.PrivateKey) (logCheckpoint, error) {
+	report, err := verifyLogChain()
+	if err != nil {
+		return logCheckpoint{}, err
+	}
+	if !report.Valid {
+		return logCheckpoint{}, fmt.Errorf("哈希链校验失败, id: %d, %s", report.BrokenAt, report.Reason)
+	}
+
+	checkpoint := logCheckpoint{
+		LastID:    report.LastID,
+		LastHash:  report.LastHash,
+		Count:     report.Archived + report.Checked,
+		CreatedAt: time.Now().Truncate(time.Second),
+	}
+	checkpoint.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, checkpoint.signingPayload()))
+	return checkpoint, nil
+}
+
+// verifyLogCheckpoint 校验检查点签名以及检查点对应的日志是否仍在链上
+func verifyLogCheckpoint(checkpoint logCheckpoint) error {
+	publicKey, err := base64.StdEncoding.DecodeString(AppConfig.Audit.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("未配置有效的审计公钥")
+	}
+	signature, err := base64.StdEncoding.DecodeString(checkpoint.Signature)
+	if err != nil || !ed25519.Verify(publicKey, checkpoint.signingPayload(), signature) {
+		return fmt.Errorf("检查点签名无效")
+	}
+
+	// 检查点之前的日志可能已归档
+	var found bool
+	var count int64
+	err = scanArchives(func(l WhitelistLog) error {
+		if l.ID <= checkpoint.LastID {
+			count++
+		}
+		if l.ID == checkpoint.LastID {
+			found = l.Hash == checkpoint.LastHash
+			if !found {
+				return fmt.Errorf("检查点对应的日志 %d 哈希不一致", checkpoint.LastID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		var row WhitelistLog
+		if err := DB.Unscoped().Select("id", "hash").Where("id = ?", checkpoint.LastID).First(&row).Error; err != nil {
+			return fmt.Errorf("检查点对应的日志 %d 不存在: %w", checkpoint.LastID, err)
+		}
+		if row.Hash != checkpoint.LastHash {
+			return fmt.Errorf("检查点对应的日志 %d 哈希不一致", checkpoint.LastID)
+		}
+	}
+
+	var dbCount int64
+	if err := DB.Unscoped().Model(&WhitelistLog{}).Where("id <= ?", checkpoint.LastID).Count(&dbCount).Error; err != nil {
+		return err
+	}
+	count += dbCount
+	if count != checkpoint.Count {
+		return fmt.Errorf("检查点之前的日志数量不一致, 检查点: %d, 当前: %d", checkpoint.Count, count)
+	}
+	return nil
+}
+
+// loadSigningKey 读取 base64 编码的 ed25519 私钥
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取私钥失败: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("解析私钥失败: %w", err)
+	}
+
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	default:
+		return nil, fmt.Errorf("私钥长度错误")
+	}
+}
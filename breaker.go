@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 服务器熔断状态
+const (
+	BreakerClosed = "closed" // 正常
+	BreakerOpen   = "open"   // 熔断，任务暂停
+)
+
+// errServerDown 服务器已熔断，不再执行命令
+var errServerDown = errors.New("服务器已熔断")
+
+// serverHealth 服务器的健康状态
+type serverHealth struct {
+	Server      string     `json:"server"`
+	Regions     []string   `json:"regions"`
+	State       string     `json:"state"`
+	Failures    int        `json:"failures"` // 连续失败次数
+	LastError   string     `json:"lastError"`
+	LastCheck   *time.Time `json:"lastCheck"`
+	LastSuccess *time.Time `json:"lastSuccess"`
+	OpenedAt    *time.Time `json:"openedAt"`
+	Waiting     int        `json:"waiting"`  // 等待服务器恢复的任务数
+	Sessions    int        `json:"sessions"` // 正在执行的远程命令数
+	MaxSessions int        `json:"maxSessions"`
+}
+
+var (
+	serverStates = make(map[string]*serverHealth)
+	muBreaker    sync.Mutex
+	breakerCond  = sync.NewCond(&muBreaker)
+)
+
+// serverState 服务器的状态，调用方需持有 muBreaker
+func serverState(server string) *serverHealth {
+	state, ok := serverStates[server]
+	if !ok {
+		state = &serverHealth{Server: server, State: BreakerClosed}
+		serverStates[server] = state
+	}
+	return state
+}
+
+// serverAvailable 服务器是否未熔断
+func serverAvailable(server string) bool {
+	muBreaker.Lock()
+	defer muBreaker.Unlock()
+	return serverState(server).State != BreakerOpen
+}
+
+// waitServer 服务器熔断时等待探测恢复，暂停该服务器上的任务
+func waitServer(server string) {
+	muBreaker.Lock()
+	defer muBreaker.Unlock()
+
+	state := serverState(server)
+	if state.State != BreakerOpen {
+		return
+	}
+	log.Printf("服务器 %s 已熔断，任务等待恢复", server)
+	state.Waiting++
+	for state.State == BreakerOpen {
+		breakerCond.Wait()
+	}
+	state.Waiting--
+}
+
+// recordServerResult 根据命令结果更新服务器状态，只有临时错误计为服务器故障
+func recordServerResult(server string, result commandResult, err error) {
+	if event, changed := updateServerState(server, result, err); changed {
+		notify(event)
+	}
+}
+
+// updateServerState 更新服务器状态，熔断或恢复时返回需要发送的通知
+func updateServerState(server string, result commandResult, err error) (NotifyEvent, bool) {
+	now := time.Now()
+	muBreaker.Lock()
+	defer muBreaker.Unlock()
+
+	state := serverState(server)
+	state.LastCheck = &now
+	if !isRetryable(result, err) {
+		state.Failures, state.LastSuccess = 0, &now
+		if state.State != BreakerOpen {
+			return NotifyEvent{}, false
+		}
+		state.State, state.OpenedAt = BreakerClosed, nil
+		breakerCond.Broadcast()
+		return NotifyEvent{Type: EventServerUp, Server: server}, true
+	}
+
+	state.Failures++
+	state.LastError = err.Error()
+	if state.State == BreakerClosed && state.Failures >= AppConfig.Breaker.FailureThreshold {
+		state.State, state.OpenedAt = BreakerOpen, &now
+		return NotifyEvent{Type: EventServerDown, Server: server, Count: state.Failures, Error: state.LastError}, true
+	}
+	return NotifyEvent{}, false
+}
+
+// remoteServers 各地区用到的服务器
+func remoteServers() map[string][]string {
+	servers := make(map[string][]string)
+	for country, r := range regions {
+		servers[r.Server] = append(servers[r.Server], country)
+	}
+	for _, countries := range servers {
+		sort.Strings(countries)
+	}
+	return servers
+}
+
+// probeServers 定期探测各服务器，熔断的服务器探测成功后恢复
+func probeServers() {
+	for range time.Tick(time.Duration(AppConfig.Breaker.ProbeInterval) * time.Second) {
+		for server := range remoteServers() {
+			result, err := executeSSHCommand(server, AppConfig.Breaker.ProbeCommand)
+			if err != nil && !isRetryable(result, err) {
+				// 探测命令本身失败说明连接正常
+				log.Printf("探测服务器 %s 的命令失败: %v", server, err)
+			}
+			recordServerResult(server, result, err)
+		}
+	}
+}
+
+// serverStatus 各服务器的健康状态
+func serverStatus(c *gin.Context) {
+	servers := remoteServers()
+	muBreaker.Lock()
+	list := make([]serverHealth, 0, len(servers))
+	for server, countries := range servers {
+		state := *serverState(server)
+		state.Regions = countries
+		list = append(list, state)
+	}
+	muBreaker.Unlock()
+
+	for i := range list {
+		slot := serverSlot(list[i].Server)
+		list[i].Sessions, list[i].MaxSessions = len(slot), cap(slot)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Server < list[j].Server })
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": list})
+}
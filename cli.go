@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const cliUsage = `用法:
+  keygen -out <私钥文件>                      生成审计检查点签名密钥
+  checkpoint -key <私钥文件> [-out <文件>]    校验日志哈希链并导出签名检查点
+  archive                                     按 retention 配置立即归档旧日志`
+
+// runCommand 执行子命令
+func runCommand(args []string) error {
+	switch args[0] {
+	case "keygen":
+		return keygenCommand(args[1:])
+	case "checkpoint", "archive":
+	default:
+		return fmt.Errorf("未知的子命令: %s\n%s", args[0], cliUsage)
+	}
+
+	// 其余子命令需要数据库
+	if err := openDatabase(databaseDSN); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "checkpoint":
+		return checkpointCommand(args[1:])
+	case "archive":
+		total, err := archiveWhitelistLogs()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("已归档 %d 条日志\n", total)
+	}
+	return nil
+}
+
+// keygenCommand 生成 ed25519 密钥，私钥写入文件，公钥打印后配置到 audit.publicKey
+func keygenCommand(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "audit.key", "私钥文件")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, []byte(base64.StdEncoding.EncodeToString(privateKey.Seed())+"\n"), 0600); err != nil {
+		return err
+	}
+
+	fmt.Println("私钥已写入:", *out)
+	fmt.Println("公钥:", base64.StdEncoding.EncodeToString(publicKey))
+	return nil
+}
+
+// checkpointCommand 导出签名检查点
+func checkpointCommand(args []string) error {
+	fs := flag.NewFlagSet("checkpoint", flag.ExitOnError)
+	keyPath := fs.String("key", "audit.key", "私钥文件")
+	out := fs.String("out", "", "输出文件，为空输出到标准输出")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := loadSigningKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	checkpoint, err := newLogCheckpoint(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		fmt.Println(string(data))
+		return nil
+	}
+	return os.WriteFile(*out, append(data, '\n'), 0644)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// 默认的 Lark 机器人地址，未提供配置文件时使用
+const defaultWebhookURL = "https://open.larksuite.com/open-apis/bot/v2/hook/2ee21888-8088-463d-ad32-d8ab70c09696"
+
+// Config 程序配置，从 JSON 文件加载
+type Config struct {
+	Lark      LarkConfig      `json:"lark"`
+	Notify    NotifyConfig    `json:"notify"`
+	Audit     AuditConfig     `json:"audit"`
+	Retention RetentionConfig `json:"retention"`
+	Activity  ActivityConfig  `json:"activity"`
+	// Aggregation 按地区（国家代码）配置IP聚合的前缀长度，default 为兜底
+	Aggregation map[string]AggregationPrefix `json:"aggregation"`
+	// Policy 按地区（国家代码）配置添加IP的校验规则，default 为兜底
+	Policy map[string]PolicyConfig `json:"policy"`
+	Quota  QuotaConfig             `json:"quota"`
+	GeoIP  GeoIPConfig             `json:"geoip"`
+	// Schedule 按地区（国家代码）配置允许变更的时段，default 为兜底
+	Schedule map[string]ScheduleConfig `json:"schedule"`
+	Queue    QueueConfig               `json:"queue"`
+	// Retry 按步骤（ingress、bsicrontask）配置远程命令的重试，default 为兜底
+	Retry   map[string]RetryPolicy `json:"retry"`
+	Breaker BreakerConfig          `json:"breaker"`
+}
+
+// BreakerConfig 服务器熔断配置，连续临时错误达到阈值后熔断，探测恢复前暂停该服务器的任务
+type BreakerConfig struct {
+	FailureThreshold int    `json:"failureThreshold"` // 连续失败多少次后熔断
+	ProbeInterval    int    `json:"probeInterval"`    // 探测服务器的间隔秒数
+	ProbeCommand     string `json:"probeCommand"`     // 探测时执行的命令
+}
+
+// RetryPolicy 远程命令遇到超时、连接失败等临时错误时按指数退避重试
+type RetryPolicy struct {
+	MaxAttempts  int     `json:"maxAttempts"`  // 最多执行次数，1 表示不重试
+	InitialDelay int     `json:"initialDelay"` // 第一次重试前等待的秒数
+	MaxDelay     int     `json:"maxDelay"`     // 等待秒数的上限
+	Multiplier   float64 `json:"multiplier"`   // 每次重试等待时间的倍数
+}
+
+// QueueConfig 商户处理队列的配置
+type QueueConfig struct {
+	AdminRoles     []string       `json:"adminRoles"`     // 可以取消他人请求和调整优先级的角色
+	Workers        int            `json:"workers"`        // 同时处理请求的商户数
+	MaxSessions    int            `json:"maxSessions"`    // 同时执行的远程命令总数
+	ServerSessions map[string]int `json:"serverSessions"` // 每台服务器同时执行的远程命令数，default 为兜底
+}
+
+// ScheduleConfig 地区的变更时段，时间按上海时区，不在允许时段内的变更挂起到时段开始后执行
+type ScheduleConfig struct {
+	Windows   []TimeWindow `json:"windows"`   // 维护窗口，配置后只在窗口内执行变更
+	Blackouts []TimeWindow `json:"blackouts"` // 禁止变更的时段，优先于维护窗口
+}
+
+// TimeWindow 每周重复的时段，End 小于 Start 时跨零点
+type TimeWindow struct {
+	Weekdays []int  `json:"weekdays"` // 0 为周日，为空表示每天，跨零点时按开始的日期
+	Start    string `json:"start"`    // 15:04
+	End      string `json:"end"`      // 15:04
+}
+
+// GeoIPConfig 离线 GeoIP 数据库配置，用于识别IP的归属国家和 ASN
+type GeoIPConfig struct {
+	Database     string              `json:"database"`     // MaxMind 格式的国家或城市库，为空表示不启用
+	ASNDatabase  string              `json:"asnDatabase"`  // ASN 库，可选
+	Mode         string              `json:"mode"`         // 归属地与预期国家不一致时: off 不处理，warn 发送提醒，approve 需审批后执行
+	Countries    map[string][]string `json:"countries"`    // 各地区预期的 ISO 国家代码
+	Merchants    map[string][]string `json:"merchants"`    // 单个商户预期的 ISO 国家代码，优先于地区
+	ApproveRoles []string            `json:"approveRoles"` // 可以审批的角色
+}
+
+// QuotaConfig 每个商户白名单条目数的上限，0 表示不限制
+type QuotaConfig struct {
+	Regions     map[string]int `json:"regions"`     // 按地区（国家代码）的默认上限，default 为兜底
+	Merchants   map[string]int `json:"merchants"`   // 单个商户的上限，优先于地区
+	WarnPercent int            `json:"warnPercent"` // 使用量超过该百分比时发送 Lark 提醒
+}
+
+// PolicyConfig 添加IP时的校验规则，禁止列表优先，其次可信列表中的网段跳过其余规则
+type PolicyConfig struct {
+	DenyPrivate     bool     `json:"denyPrivate"`     // 私有地址 10/8、172.16/12、192.168/16、fc00::/7
+	DenyLoopback    bool     `json:"denyLoopback"`    // 回环地址
+	DenyLinkLocal   bool     `json:"denyLinkLocal"`   // 链路本地地址
+	DenyMulticast   bool     `json:"denyMulticast"`   // 组播地址
+	DenyUnspecified bool     `json:"denyUnspecified"` // 0.0.0.0 和 ::
+	MinPrefixV4     int      `json:"minPrefixV4"`     // IPv4 网段的最小前缀长度，0 表示不限制
+	MinPrefixV6     int      `json:"minPrefixV6"`     // IPv6 网段的最小前缀长度，0 表示不限制
+	Deny            []string `json:"deny"`            // 禁止的IP或网段
+	TrustedFile     string   `json:"trustedFile"`     // 可信网段文件，如可信 ASN 的网段，每行一个，# 后为注释
+}
+
+// AggregationPrefix 判断重复和下发 ingress 时IP聚合的前缀长度，0 使用默认值
+type AggregationPrefix struct {
+	IPv6 int `json:"ipv6"` // 默认 48
+	IPv4 int `json:"ipv4"` // 默认 32，即不聚合
+}
+
+// ActivityConfig 操作异常告警的阈值，时间按上海时区
+type ActivityConfig struct {
+	MassDeleteIPs     int  `json:"massDeleteIPs"`     // 时间窗口内同一用户删除的IP数达到阈值时告警，0 表示不告警
+	MassDeleteMinutes int  `json:"massDeleteMinutes"` // 批量删除的时间窗口
+	WorkStartHour     int  `json:"workStartHour"`     // 工作时间开始，含
+	WorkEndHour       int  `json:"workEndHour"`       // 工作时间结束，不含，与开始相同表示不检查
+	WeekendOff        bool `json:"weekendOff"`        // 周末视为非工作时间
+	NewMerchant       bool `json:"newMerchant"`       // 用户首次操作某商户时告警
+}
+
+// RetentionConfig 操作日志保留配置
+type RetentionConfig struct {
+	Days          int    `json:"days"`          // 超过天数的日志移入归档，0 表示不归档
+	ArchiveDir    string `json:"archiveDir"`    // 归档目录，按月生成 gzip 压缩的 NDJSON 文件
+	IntervalHours int    `json:"intervalHours"` // 归档检查间隔
+}
+
+// AuditConfig 审计日志配置
+type AuditConfig struct {
+	PublicKey string `json:"publicKey"` // 校验检查点签名的 ed25519 公钥，base64 编码
+}
+
+// NotifyConfig 通知消息配置
+type NotifyConfig struct {
+	TemplateDir   string `json:"templateDir"`   // 自定义模板目录，结构为 <语言>/<事件>.tmpl，为空使用内置模板
+	DefaultLocale string `json:"defaultLocale"` // 默认语言
+}
+
+// LarkConfig Lark 通知配置
+type LarkConfig struct {
+	// Bots 按环境（国家代码，如 br/pk/vn/ph）配置机器人，default 为兜底
+	Bots map[string][]LarkBot `json:"bots"`
+	// App 自建应用，用于接收事件订阅和回复消息
+	App LarkApp `json:"app"`
+}
+
+// LarkApp Lark 自建应用配置
+type LarkApp struct {
+	BaseURL           string   `json:"baseURL"`
+	AppID             string   `json:"appID"`
+	AppSecret         string   `json:"appSecret"`
+	VerificationToken string   `json:"verificationToken"`
+	EncryptKey        string   `json:"encryptKey"`  // 开启加密推送时的 Encrypt Key
+	ModifyRoles       []string `json:"modifyRoles"` // 允许通过机器人修改白名单的角色
+	Locale            string   `json:"locale"`      // 会话回复和私信使用的语言
+}
+
+// LarkBot 单个 Lark 自定义机器人
+type LarkBot struct {
+	Name       string `json:"name"`
+	WebhookURL string `json:"webhookURL"`
+	Secret     string `json:"secret"` // 开启签名校验时的密钥，为空则不签名
+	Locale     string `json:"locale"` // 消息语言，zh 或 en，为空使用默认语言
+}
+
+var AppConfig = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Lark: LarkConfig{
+			Bots: map[string][]LarkBot{
+				"default": {{Name: "default", WebhookURL: defaultWebhookURL}},
+			},
+			App: LarkApp{
+				BaseURL:     "https://open.larksuite.com",
+				ModifyRoles: []string{"admin"},
+			},
+		},
+		Notify: NotifyConfig{
+			DefaultLocale: "zh",
+		},
+		Retention: RetentionConfig{
+			ArchiveDir:    "archive",
+			IntervalHours: 24,
+		},
+		Activity: ActivityConfig{
+			MassDeleteIPs:     20,
+			MassDeleteMinutes: 60,
+			WorkStartHour:     9,
+			WorkEndHour:       20,
+			WeekendOff:        true,
+			NewMerchant:       true,
+		},
+		Aggregation: map[string]AggregationPrefix{
+			"default": {IPv6: 48, IPv4: 32},
+		},
+		Policy: map[string]PolicyConfig{
+			"default": {
+				DenyPrivate:     true,
+				DenyLoopback:    true,
+				DenyLinkLocal:   true,
+				DenyMulticast:   true,
+				DenyUnspecified: true,
+				MinPrefixV4:     16,
+				MinPrefixV6:     32,
+			},
+		},
+		GeoIP: GeoIPConfig{
+			Mode: "warn",
+			Countries: map[string][]string{
+				"br": {"BR"},
+				"pk": {"PK"},
+				"vn": {"VN"},
+				"ph": {"PH"},
+			},
+			Merchants:    map[string][]string{},
+			ApproveRoles: []string{"admin"},
+		},
+		Quota: QuotaConfig{
+			Regions:     map[string]int{"default": 0},
+			Merchants:   map[string]int{},
+			WarnPercent: 80,
+		},
+		Queue: QueueConfig{
+			AdminRoles:     []string{"admin"},
+			Workers:        8,
+			MaxSessions:    8,
+			ServerSessions: map[string]int{"default": 2},
+		},
+		Retry: map[string]RetryPolicy{
+			"default": {MaxAttempts: 3, InitialDelay: 2, MaxDelay: 30, Multiplier: 2},
+		},
+		Breaker: BreakerConfig{
+			FailureThreshold: 3,
+			ProbeInterval:    30,
+			ProbeCommand:     "true",
+		},
+	}
+}
+
+// configPath 配置文件路径，可通过环境变量 WHITELIST_CONFIG 指定
+func configPath() string {
+	if path := os.Getenv("WHITELIST_CONFIG"); path != "" {
+		return path
+	}
+	return "config.json"
+}
+
+// loadConfig 读取配置文件，文件不存在时使用默认配置
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %w", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %w", err)
+	}
+	if cfg.Retention.IntervalHours <= 0 {
+		cfg.Retention.IntervalHours = 24
+	}
+	for step, policy := range cfg.Retry {
+		if policy.MaxAttempts < 1 {
+			policy.MaxAttempts = 1
+		}
+		if policy.Multiplier < 1 {
+			policy.Multiplier = 1
+		}
+		cfg.Retry[step] = policy
+	}
+	if cfg.Queue.Workers <= 0 {
+		cfg.Queue.Workers = 8
+	}
+	if cfg.Queue.MaxSessions <= 0 {
+		cfg.Queue.MaxSessions = 8
+	}
+	if cfg.Breaker.FailureThreshold <= 0 {
+		cfg.Breaker.FailureThreshold = 3
+	}
+	if cfg.Breaker.ProbeInterval <= 0 {
+		cfg.Breaker.ProbeInterval = 30
+	}
+	if cfg.Breaker.ProbeCommand == "" {
+		cfg.Breaker.ProbeCommand = "true"
+	}
+	if cfg.Quota.WarnPercent <= 0 || cfg.Quota.WarnPercent > 100 {
+		cfg.Quota.WarnPercent = 80
+	}
+	for country, schedule := range cfg.Schedule {
+		for _, window := range append(schedule.Windows, schedule.Blackouts...) {
+			if _, _, err := window.minutes(); err != nil {
+				return nil, fmt.Errorf("地区 %s 的变更时段格式错误: %w", country, err)
+			}
+		}
+	}
+	switch cfg.GeoIP.Mode {
+	case "off", "warn", "approve":
+	default:
+		return nil, fmt.Errorf("geoip.mode 只能是 off、warn 或 approve")
+	}
+	for country, prefix := range cfg.Aggregation {
+		if prefix.IPv6 < 0 || prefix.IPv6 > 128 || prefix.IPv4 < 0 || prefix.IPv4 > 32 {
+			return nil, fmt.Errorf("地区 %s 的聚合前缀长度错误", country)
+		}
+	}
+	return cfg, nil
+}
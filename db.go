@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,21 +17,196 @@ type User struct {
 	PasswordHash  string    `gorm:"size:128"`
 	LastLoginTime time.Time `gorm:"default:null"`
 	Role          string    `json:"role" gorm:"size:20;not null"`
+	LarkOpenID    string    `json:"larkOpenId" gorm:"size:64;index"`
+	LarkEmail     string    `json:"larkEmail" gorm:"size:128"`
+	LarkDM        bool      `json:"larkDM"` // 失败时是否私信通知
 }
 
+// 操作日志的状态
+const (
+	LogStatusSuccess    = "success"
+	LogStatusFailed     = "failed"
+	LogStatusRolledBack = "rolled_back"
+	LogStatusSkipped    = "skipped"
+	LogStatusCancelled  = "cancelled"
+	LogStatusPending    = "pending" // 已提交审批或保存为计划变更，执行时另有日志
+)
+
+// 操作来源
+const (
+	SourceUI      = "ui"
+	SourceAPI     = "api"
+	SourceChat    = "chat"
+	SourceImport  = "import"
+	SourceExpire  = "expire"  // 到期自动删除
+	SourceRestore = "restore" // 恢复到历史版本
+	SourceApprove = "approve" // 审批通过后执行
+	SourceRetry   = "retry"   // 手动重试失败的操作
+)
+
+// maxLogOutput 日志中保存的远程命令输出的最大长度
+const maxLogOutput = 4000
+
 type WhitelistLog struct {
 	gorm.Model
-	IP           string `json:"ip"`
+	IP           string `json:"ip"` // 请求的IP
 	MerchantName string `json:"merchantName"`
 	Act          string `json:"act"`
 	OpUser       string `json:"opUser"`
+	Country      string `json:"country" gorm:"size:8;index"`
+	Status       string `json:"status" gorm:"size:20;default:success;index"`
+	ChangedIPs   string `json:"changedIPs"` // 实际变更的IP
+	BeforeIPs    string `json:"beforeIPs"`  // 变更前的IP列表
+	AfterIPs     string `json:"afterIPs"`   // 变更后的IP列表
+	ExitCodes    string `json:"exitCodes"`  // 远程命令的退出码，逗号分隔
+	Output       string `json:"output"`     // 远程命令的输出，超长截断
+	Message      string `json:"message"`    // 失败原因
+	Source       string `json:"source" gorm:"size:10"`
+	ClientIP     string `json:"clientIP" gorm:"size:64"`
+	RetryOf      uint   `json:"retryOf" gorm:"index"`    // 重试时为原操作的日志
+	PrevHash     string `json:"prevHash" gorm:"size:64"` // 上一条日志的哈希
+	Hash         string `json:"hash" gorm:"size:64;index"`
+}
+
+// WhiteListIPMeta 白名单IP的备注和过期时间
+type WhiteListIPMeta struct {
+	gorm.Model
+	MerchantName string     `json:"merchantName" gorm:"index"`
+	Country      string     `json:"country" gorm:"size:8"`
+	IP           string     `json:"ip"`
+	Note         string     `json:"note"`
+	ExpiresAt    *time.Time `json:"expiresAt" gorm:"index"`
+	OpUser       string     `json:"opUser"`
+	GeoCountry   string     `json:"geoCountry" gorm:"size:2"` // GeoIP 解析的 ISO 国家代码
+	ASN          uint       `json:"asn"`
+	ASOrg        string     `json:"asOrg"`
+}
+
+// 审批状态
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// WhitelistApproval 归属地不一致等待审批的请求
+type WhitelistApproval struct {
+	gorm.Model
+	MerchantName string       `json:"merchantName" gorm:"index"`
+	Country      string       `json:"country"`
+	IP           string       `json:"ip"`
+	Action       string       `json:"action"`
+	OpUser       string       `json:"opUser"`
+	Source       string       `json:"source" gorm:"size:10"`
+	ClientIP     string       `json:"clientIP" gorm:"size:64"`
+	Reason       string       `json:"reason"`
+	Status       string       `json:"status" gorm:"size:20;default:pending;index"`
+	Approver     string       `json:"approver"`
+	ApprovedAt   *time.Time   `json:"approvedAt"`
+	Metas        []importMeta `json:"metas" gorm:"serializer:json"` // 导入的备注和过期时间
+}
+
+// WhitelistVersion 商户IP列表每次变更后的快照
+type WhitelistVersion struct {
+	gorm.Model
+	MerchantName string `json:"merchantName" gorm:"uniqueIndex:idx_merchant_version"`
+	Version      int    `json:"version" gorm:"uniqueIndex:idx_merchant_version"`
+	Country      string `json:"country" gorm:"size:8"`
+	IP           string `json:"ip"`  // 变更后的IP列表
+	Act          string `json:"act"` // add/del，baseline 为首次记录时已有的IP
+	ChangedIPs   string `json:"changedIPs"`
+	OpUser       string `json:"opUser"`
+	LogID        uint   `json:"logId"` // 对应的操作日志
 }
+
 type WhiteList struct {
-	ID           uint   `gorm:"primaryKey"`
+	ID           uint       `gorm:"primaryKey"`
+	MerchantName string     `json:"merchantName"`
+	IP           string     `json:"IP"`
+	OpUser       string     `json:"opUser"`
+	Country      string     `json:"country"`              // 请求中可逗号分隔多个地区，all 为商户已存在的所有地区
+	Collapse     bool       `json:"collapse" gorm:"-"`    // 新增网段包含已有条目时合并
+	ScheduledAt  *time.Time `json:"scheduledAt" gorm:"-"` // 计划执行时间，为空立即执行
+}
+
+// 计划变更的状态
+const (
+	ScheduledPending   = "pending"
+	ScheduledDone      = "done"
+	ScheduledCancelled = "cancelled"
+)
+
+// ScheduledChange 计划执行或因变更时段挂起的请求
+type ScheduledChange struct {
+	gorm.Model
+	MerchantName string       `json:"merchantName" gorm:"index"`
+	Country      string       `json:"country"`
+	IP           string       `json:"ip"`
+	Action       string       `json:"action"`
+	OpUser       string       `json:"opUser"`
+	Collapse     bool         `json:"collapse"`
+	Source       string       `json:"source" gorm:"size:10"`
+	ClientIP     string       `json:"clientIP" gorm:"size:64"`
+	ScheduledAt  time.Time    `json:"scheduledAt" gorm:"index"`
+	Status       string       `json:"status" gorm:"size:20;default:pending;index"`
+	Reason       string       `json:"reason"` // 挂起原因
+	CancelledBy  string       `json:"cancelledBy"`
+	Metas        []importMeta `json:"metas" gorm:"serializer:json"` // 导入的备注和过期时间
+}
+
+// 多商户任务的状态，子任务使用日志的状态，未完成时为 pending
+const (
+	JobRunning = "running"
+	JobSuccess = "success"
+	JobPartial = "partial" // 部分商户失败
+	JobFailed  = "failed"
+	JobPending = "pending"
+)
+
+// WhitelistJob 多商户或多地区请求的父任务，每个商户的每个地区一个子任务
+type WhitelistJob struct {
+	gorm.Model
+	MerchantName string            `json:"merchantName"` // 逗号分隔
+	Country      string            `json:"country"`      // 逗号分隔，all 为商户已存在的所有地区
+	IP           string            `json:"ip"`
+	Action       string            `json:"action"`
+	OpUser       string            `json:"opUser"`
+	Source       string            `json:"source" gorm:"size:10"`
+	ClientIP     string            `json:"clientIP" gorm:"size:64"`
+	Status       string            `json:"status" gorm:"size:20;index"`
+	Total        int               `json:"total"`
+	Succeeded    int               `json:"succeeded"`
+	Failed       int               `json:"failed"`
+	Skipped      int               `json:"skipped"` // 无变更或已取消
+	SubJobs      []WhitelistSubJob `json:"subJobs,omitempty" gorm:"foreignKey:JobID"`
+}
+
+// WhitelistSubJob 父任务中单个商户在一个地区的执行结果
+type WhitelistSubJob struct {
+	gorm.Model
+	JobID        uint   `json:"jobId" gorm:"index"`
 	MerchantName string `json:"merchantName"`
-	IP           string `json:"IP"`
-	OpUser       string `json:"opUser"`
-	Country      string `json:"country"`
+	Country      string `json:"country" gorm:"size:8"`
+	Status       string `json:"status" gorm:"size:20"`
+	Message      string `json:"message"`
+}
+
+// setCommandResults 记录远程命令的退出码和输出
+func (l *WhitelistLog) setCommandResults(results []commandResult) {
+	exitCodes := make([]string, 0, len(results))
+	var output strings.Builder
+	for _, result := range results {
+		exitCodes = append(exitCodes, strconv.Itoa(result.ExitCode))
+		if result.Attempt > 1 {
+			fmt.Fprintf(&output, "# %s 第 %d 次执行\n", result.Step, result.Attempt)
+		}
+		fmt.Fprintf(&output, "$ %s\n%s\n", result.Command, result.Output)
+	}
+	l.ExitCodes = strings.Join(exitCodes, ",")
+	l.Output = output.String()
+	if len(l.Output) > maxLogOutput {
+		l.Output = strings.ToValidUTF8(l.Output[:maxLogOutput], "") + "...(truncated)"
+	}
 }
 
 func (u *User) SetPassword(password string) string {
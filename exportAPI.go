@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportWriter 逐行写出导出文件
+type exportWriter interface {
+	WriteRow(values []string) error
+	Close() error
+}
+
+// csvExport CSV 导出
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) WriteRow(values []string) error {
+	return e.w.Write(values)
+}
+
+func (e *csvExport) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonExport JSON Lines 导出，每行一个对象
+type ndjsonExport struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+func (e *ndjsonExport) WriteRow(values []string) error {
+	item := make(map[string]string, len(values))
+	for i, column := range e.columns {
+		item[column] = values[i]
+	}
+	return e.enc.Encode(item)
+}
+
+func (e *ndjsonExport) Close() error {
+	return nil
+}
+
+// xlsxExport XLSX 导出，使用流式写入，超出内存阈值时写入临时文件
+type xlsxExport struct {
+	f   *excelize.File
+	sw  *excelize.StreamWriter
+	out io.Writer
+	row int
+}
+
+func (e *xlsxExport) WriteRow(values []string) error {
+	e.row++
+	cells := make([]interface{}, len(values))
+	for i, value := range values {
+		cells[i] = value
+	}
+	cell, err := excelize.CoordinatesToCellName(1, e.row)
+	if err != nil {
+		return err
+	}
+	return e.sw.SetRow(cell, cells)
+}
+
+func (e *xlsxExport) Close() error {
+	defer e.f.Close()
+	if err := e.sw.Flush(); err != nil {
+		return err
+	}
+	return e.f.Write(e.out)
+}
+
+// newExportWriter 按格式创建导出，写出表头
+func newExportWriter(format string, out io.Writer, columns []string) (exportWriter, error) {
+	var e exportWriter
+	switch format {
+	case "csv":
+		e = &csvExport{w: csv.NewWriter(out)}
+	case "ndjson":
+		return &ndjsonExport{enc: json.NewEncoder(out), columns: columns}, nil
+	case "xlsx":
+		f := excelize.NewFile()
+		sw, err := f.NewStreamWriter("Sheet1")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		e = &xlsxExport{f: f, sw: sw, out: out}
+	default:
+		return nil, fmt.Errorf("不支持的导出格式: %s", format)
+	}
+	return e, e.WriteRow(columns)
+}
+
+// exportContentTypes 各格式的 Content-Type
+var exportContentTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+	"xlsx":   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// startExport 校验格式并写出下载的响应头，文件名带上海时区的时间戳
+func startExport(c *gin.Context, name string, columns []string) (exportWriter, bool) {
+	format := c.DefaultQuery("format", "csv")
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": fmt.Sprintf("不支持的导出格式: %s", format),
+		})
+		return nil, false
+	}
+
+	filename := fmt.Sprintf("%s_%s.%s", name, time.Now().In(time.Local).Format("20060102_150405"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Status(http.StatusOK)
+
+	e, err := newExportWriter(format, c.Writer, columns)
+	if err != nil {
+		c.Error(err)
+		return nil, false
+	}
+	return e, true
+}
+
+// logExportColumns 日志导出的列
+var logExportColumns = []string{"id", "created_at", "country", "merchant_name", "act", "status", "op_user", "ip", "changed_ips", "before_ips", "after_ips", "exit_codes", "output", "message", "source", "client_ip", "hash"}
+
+// whitelistLogExport 按列表相同的条件导出日志，archive=true 时合并归档的日志
+func whitelistLogExport(c *gin.Context) {
+	q, err := parseLogQuery(c)
+	if err == nil {
+		err = q.resolve(DB)
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var archived []WhitelistLog
+	if c.DefaultQuery("archive", "false") == "true" {
+		if archived, err = archivedLogs(q); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code":  50000,
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	rows, err := DB.Model(&WhitelistLog{}).Scopes(q.where, q.order).Rows()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":  50000,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer rows.Close()
+
+	e, ok := startExport(c, "whitelist_logs", logExportColumns)
+	if !ok {
+		return
+	}
+
+	writeLog := func(l WhitelistLog) error {
+		return e.WriteRow([]string{
+			strconv.FormatUint(uint64(l.ID), 10), l.CreatedAt.In(time.Local).Format("2006-01-02 15:04:05"),
+			l.Country, l.MerchantName, l.Act, l.Status, l.OpUser, l.IP, l.ChangedIPs, l.BeforeIPs, l.AfterIPs,
+			l.ExitCodes, l.Output, l.Message, l.Source, l.ClientIP, l.Hash,
+		})
+	}
+
+	// 数据库和归档都已排序，按顺序合并
+	for err == nil && rows.Next() {
+		var l WhitelistLog
+		if err = DB.ScanRows(rows, &l); err != nil {
+			break
+		}
+		for err == nil && len(archived) > 0 && logItemLess(q, newLogListItem(archived[0]), newLogListItem(l)) {
+			err = writeLog(archived[0])
+			archived = archived[1:]
+		}
+		if err == nil {
+			err = writeLog(l)
+		}
+	}
+	for err == nil && len(archived) > 0 {
+		err = writeLog(archived[0])
+		archived = archived[1:]
+	}
+	if err != nil {
+		c.Error(err)
+	}
+	if err := e.Close(); err != nil {
+		c.Error(err)
+	}
+}
+
+// whitelistExportColumns 白名单导出的列，每个IP一行
+var whitelistExportColumns = []string{"merchant_name", "country", "ip", "op_user"}
+
+// whitelistExport 导出当前白名单，可按 country、merchantName 过滤
+func whitelistExport(c *gin.Context) {
+	query := DB.Model(&WhiteList{}).Order("country, merchant_name")
+	if country := c.DefaultQuery("country", ""); country != "" {
+		query = query.Where("country = ?", country)
+	}
+	if merchantName := c.DefaultQuery("merchantName", ""); merchantName != "" {
+		query = query.Where("merchant_name = ?", merchantName)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":  50000,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer rows.Close()
+
+	e, ok := startExport(c, "whitelists", whitelistExportColumns)
+	if !ok {
+		return
+	}
+
+	for rows.Next() {
+		var whiteList WhiteList
+		err := DB.ScanRows(rows, &whiteList)
+		for _, ip := range strings.Split(whiteList.IP, "\n") {
+			if ip = strings.TrimSpace(ip); ip == "" || err != nil {
+				continue
+			}
+			err = e.WriteRow([]string{whiteList.MerchantName, whiteList.Country, ip, whiteList.OpUser})
+		}
+		if err != nil {
+			c.Error(err)
+			break
+		}
+	}
+	if err := e.Close(); err != nil {
+		c.Error(err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"log"
+	"net"
+	"strings"
+)
+
+// 离线 GeoIP 数据库，未配置时为空
+var (
+	geoCountryDB *maxminddb.Reader
+	geoASNDB     *maxminddb.Reader
+)
+
+// geoRecord 国家库和 ASN 库中用到的字段
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoInfo IP的归属信息
+type geoInfo struct {
+	Country string `json:"country"`
+	ASN     uint   `json:"asn"`
+	ASOrg   string `json:"asOrg"`
+}
+
+// geoMismatchError 归属地与预期国家不一致，需要审批
+type geoMismatchError struct {
+	Mismatches []string
+}
+
+func (e *geoMismatchError) Error() string {
+	return "IP归属地与商户国家不一致: " + strings.Join(e.Mismatches, "; ")
+}
+
+// openGeoIP 打开配置的 GeoIP 数据库
+func openGeoIP(cfg GeoIPConfig) error {
+	var err error
+	if cfg.Database != "" {
+		if geoCountryDB, err = maxminddb.Open(cfg.Database); err != nil {
+			return fmt.Errorf("打开 GeoIP 数据库失败: %w", err)
+		}
+	}
+	if cfg.ASNDatabase != "" {
+		if geoASNDB, err = maxminddb.Open(cfg.ASNDatabase); err != nil {
+			return fmt.Errorf("打开 ASN 数据库失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// lookupGeo 查询IP或网段的归属，网段按网络地址查询
+func lookupGeo(entry string) (geoInfo, bool) {
+	var info geoInfo
+	prefix, err := parseEntryPrefix(entry)
+	if err != nil || (geoCountryDB == nil && geoASNDB == nil) {
+		return info, false
+	}
+	ip := net.IP(prefix.Addr().AsSlice())
+
+	var record geoRecord
+	if geoCountryDB != nil {
+		if err := geoCountryDB.Lookup(ip, &record); err != nil {
+			log.Printf("查询IP %s 的归属国家失败: %v", entry, err)
+		}
+	}
+	if geoASNDB != nil {
+		if err := geoASNDB.Lookup(ip, &record); err != nil {
+			log.Printf("查询IP %s 的 ASN 失败: %v", entry, err)
+		}
+	}
+
+	info = geoInfo{Country: record.Country.ISOCode, ASN: record.AutonomousSystemNumber, ASOrg: record.AutonomousSystemOrganization}
+	return info, info != geoInfo{}
+}
+
+// expectedCountries 商户预期的 ISO 国家代码，未配置时不检查
+func expectedCountries(merchantName, country string) []string {
+	if countries, ok := AppConfig.GeoIP.Merchants[merchantName]; ok {
+		return countries
+	}
+	return AppConfig.GeoIP.Countries[country]
+}
+
+// geoMismatches 归属国家不在预期中的IP，查不到归属的IP不计入
+func geoMismatches(whiteList WhiteList, merchantName string) []string {
+	expected := expectedCountries(merchantName, whiteList.Country)
+	if AppConfig.GeoIP.Mode == "off" || geoCountryDB == nil || len(expected) == 0 {
+		return nil
+	}
+
+	mismatches := make([]string, 0)
+	for _, ip := range splitIPs(whiteList.IP) {
+		info, ok := lookupGeo(ip)
+		if !ok || info.Country == "" {
+			continue
+		}
+		found := false
+		for _, code := range expected {
+			if strings.EqualFold(code, info.Country) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			mismatches = append(mismatches, fmt.Sprintf("%s 归属 %s，预期 %s", ip, info.Country, strings.Join(expected, "/")))
+		}
+	}
+	return mismatches
+}
+
+// checkGeo 添加IP时检查归属地，warn 模式发送提醒，approve 模式返回需审批
+func checkGeo(whiteList WhiteList) error {
+	for _, merchantName := range strings.Split(whiteList.MerchantName, ",") {
+		mismatches := geoMismatches(whiteList, merchantName)
+		if len(mismatches) == 0 {
+			continue
+		}
+		if AppConfig.GeoIP.Mode == "approve" {
+			return &geoMismatchError{Mismatches: mismatches}
+		}
+		sendLarkMessage(NotifyEvent{
+			Type:     EventGeoMismatch,
+			Country:  whiteList.Country,
+			Merchant: merchantName,
+			Action:   "add",
+			OpUser:   whiteList.OpUser,
+			Error:    strings.Join(mismatches, "\n"),
+		})
+	}
+	return nil
+}
+
+// enrichWhitelistIPs 保存新增IP的归属国家和 ASN
+func enrichWhitelistIPs(merchantName, country, opUser string, ips []string) {
+	for _, ip := range ips {
+		info, ok := lookupGeo(ip)
+		if !ok {
+			continue
+		}
+		if err := saveGeoInfo(merchantName, country, opUser, ip, info); err != nil {
+			log.Printf("保存IP %s 的归属信息失败: %v", ip, err)
+		}
+	}
+}
+
+// saveGeoInfo 更新IP的归属信息，没有记录时新建
+func saveGeoInfo(merchantName, country, opUser, ip string, info geoInfo) error {
+	meta := WhiteListIPMeta{MerchantName: merchantName, Country: country, IP: ip, OpUser: opUser}
+	if err := DB.Where("merchant_name = ? AND country = ? AND ip = ?", merchantName, country, ip).Limit(1).Find(&meta).Error; err != nil {
+		return err
+	}
+	meta.GeoCountry, meta.ASN, meta.ASOrg = info.Country, info.ASN, info.ASOrg
+	return DB.Save(&meta).Error
+}
+
+// backfillGeoInfo 启动时为升级前添加、还没有归属信息的IP补齐归属
+func backfillGeoInfo() {
+	if geoCountryDB == nil && geoASNDB == nil {
+		return
+	}
+
+	var whiteLists []WhiteList
+	if err := DB.Find(&whiteLists).Error; err != nil {
+		log.Printf("补齐IP归属信息失败: %v", err)
+		return
+	}
+	var metas []WhiteListIPMeta
+	if err := DB.Where("geo_country <> '' OR asn <> 0").Find(&metas).Error; err != nil {
+		log.Printf("补齐IP归属信息失败: %v", err)
+		return
+	}
+	enriched := make(map[string]bool, len(metas))
+	for _, meta := range metas {
+		enriched[meta.MerchantName+"|"+meta.Country+"|"+meta.IP] = true
+	}
+
+	for _, whiteList := range whiteLists {
+		ips := make([]string, 0)
+		for _, ip := range splitIPs(whiteList.IP) {
+			if !enriched[whiteList.MerchantName+"|"+whiteList.Country+"|"+ip] {
+				ips = append(ips, ip)
+			}
+		}
+		enrichWhitelistIPs(whiteList.MerchantName, whiteList.Country, whiteList.OpUser, ips)
+	}
+}
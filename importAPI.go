@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxImportRows 单次导入的最大行数
+const maxImportRows = 5000
+
+// importTTL 导入结果等待确认的有效期
+const importTTL = 30 * time.Minute
+
+// importRow 导入文件中的一行
+type importRow struct {
+	Row          int        `json:"row"`
+	MerchantName string     `json:"merchantName"`
+	Country      string     `json:"country"`
+	IP           string     `json:"ip"`
+	Note         string     `json:"note"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+}
+
+// importMeta 导入时IP的备注和过期时间，添加成功后保存
+type importMeta struct {
+	IP        string     `json:"ip"`
+	Note      string     `json:"note"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// importError 行级错误
+type importError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// pendingImport 等待确认的导入
+type pendingImport struct {
+	OpUser    string
+	Rows      []importRow
+	CreatedAt time.Time
+}
+
+var (
+	pendingImports   = make(map[string]*pendingImport)
+	muPendingImports sync.Mutex
+)
+
+// importColumns 表头别名
+var importColumns = map[string]string{
+	"merchant":     "merchant",
+	"merchantname": "merchant",
+	"country":      "country",
+	"ip":           "ip",
+	"note":         "note",
+	"expires":      "expires",
+	"expiresat":    "expires",
+}
+
+// readImportFile 读取 CSV 或 XLSX 的所有行
+func readImportFile(filename string, r io.Reader) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		return reader.ReadAll()
+	case ".xlsx":
+		f, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.GetRows(f.GetSheetName(0))
+	default:
+		return nil, fmt.Errorf("仅支持 csv 和 xlsx 文件")
+	}
+}
+
+// parseImportRows 按表头解析并逐行校验
+func parseImportRows(records [][]string) ([]importRow, []importError, error) {
+	if len(records) < 2 {
+		return nil, nil, fmt.Errorf("文件为空")
+	}
+	if len(records)-1 > maxImportRows {
+		return nil, nil, fmt.Errorf("单次最多导入 %d 行", maxImportRows)
+	}
+
+	index := make(map[string]int)
+	for i, name := range records[0] {
+		key := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if column, ok := importColumns[key]; ok {
+			index[column] = i
+		}
+	}
+	for _, column := range []string{"merchant", "country", "ip"} {
+		if _, ok := index[column]; !ok {
+			return nil, nil, fmt.Errorf("缺少 %s 列", column)
+		}
+	}
+
+	cell := func(record []string, column string) string {
+		i, ok := index[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	rows := make([]importRow, 0, len(records)-1)
+	errs := make([]importError, 0)
+	seen := make(map[string]int)
+	for i, record := range records[1:] {
+		row := importRow{
+			Row:          i + 2, // 表头为第 1 行
+			MerchantName: cell(record, "merchant"),
+			Country:      cell(record, "country"),
+			IP:           cell(record, "ip"),
+			Note:         cell(record, "note"),
+		}
+		if row.MerchantName == "" && row.Country == "" && row.IP == "" {
+			continue
+		}
+
+		if err := validateImportRow(&row, cell(record, "expires")); err != nil {
+			errs = append(errs, importError{Row: row.Row, Error: err.Error()})
+			continue
+		}
+
+		key := row.MerchantName + "|" + row.Country + "|" + row.IP
+		if first, ok := seen[key]; ok {
+			errs = append(errs, importError{Row: row.Row, Error: fmt.Sprintf("与第 %d 行重复", first)})
+			continue
+		}
+		seen[key] = row.Row
+		rows = append(rows, row)
+	}
+	return rows, errs, nil
+}
+
+// validateImportRow 按白名单接口相同的规则校验一行
+func validateImportRow(row *importRow, expires string) error {
+	if row.MerchantName == "" {
+		return fmt.Errorf("商户不能为空")
+	}
+	if _, ok := regions[row.Country]; !ok {
+		return fmt.Errorf("错误的国家代码: %s", row.Country)
+	}
+	if err := ValidateWhiteListIPs(WhiteList{MerchantName: row.MerchantName, Country: row.Country, IP: row.IP}); err != nil {
+		return err
+	}
+	if err := checkIPPolicy(row.Country, row.IP); err != nil {
+		return err
+	}
+	if expires != "" {
+		expiresAt, err := parseLogTime(expires)
+		if err != nil {
+			return err
+		}
+		if !expiresAt.After(time.Now()) {
+			return fmt.Errorf("过期时间已过: %s", expires)
+		}
+		row.ExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+// newImportID 生成导入编号
+func newImportID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// whitelistImport 上传并校验导入文件，返回行级错误和待确认的导入编号
+func whitelistImport(c *gin.Context) {
+	opUser := c.PostForm("opUser")
+	if opUser == "" {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "您未登录，权限被拒绝"})
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "请上传文件"})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	records, err := readImportFile(fileHeader.Filename, file)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": fmt.Sprintf("读取文件失败: %v", err)})
+		return
+	}
+	rows, errs, err := parseImportRows(records)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": err.Error()})
+		return
+	}
+
+	importID := ""
+	if len(rows) > 0 {
+		importID = newImportID()
+		muPendingImports.Lock()
+		pendingImports[importID] = &pendingImport{OpUser: opUser, Rows: rows, CreatedAt: time.Now()}
+		muPendingImports.Unlock()
+		go func() {
+			time.Sleep(importTTL)
+			muPendingImports.Lock()
+			delete(pendingImports, importID)
+			muPendingImports.Unlock()
+		}()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 20000,
+		"data": gin.H{
+			"importId": importID,
+			"total":    len(rows) + len(errs),
+			"valid":    len(rows),
+			"rows":     rows,
+			"errors":   errs,
+		},
+	})
+}
+
+// whitelistImportConfirm 确认导入，按商户和国家合并后进入正常的处理队列
+func whitelistImportConfirm(c *gin.Context) {
+	var body struct {
+		ImportID string `json:"importId" binding:"required"`
+		OpUser   string `json:"opUser" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "格式错误"})
+		return
+	}
+
+	muPendingImports.Lock()
+	pending, ok := pendingImports[body.ImportID]
+	if ok && pending.OpUser == body.OpUser {
+		delete(pendingImports, body.ImportID)
+	}
+	muPendingImports.Unlock()
+	if !ok || pending.OpUser != body.OpUser {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "导入不存在或已过期"})
+		return
+	}
+
+	type group struct{ merchantName, country string }
+	groups := make(map[group][]string)
+	metas := make(map[group][]importMeta)
+	order := make([]group, 0)
+	for _, row := range pending.Rows {
+		g := group{row.MerchantName, row.Country}
+		if _, ok := groups[g]; !ok {
+			order = append(order, g)
+		}
+		groups[g] = append(groups[g], row.IP)
+		if row.Note != "" || row.ExpiresAt != nil {
+			metas[g] = append(metas[g], importMeta{IP: row.IP, Note: row.Note, ExpiresAt: row.ExpiresAt})
+		}
+	}
+
+	submitted := 0
+	approvals := make([]uint, 0)
+	for _, g := range order {
+		req := Request{
+			WhiteList: WhiteList{MerchantName: g.merchantName, Country: g.country, IP: strings.Join(groups[g], "\n"), OpUser: body.OpUser},
+			Action:    "add",
+			Source:    SourceImport,
+			ClientIP:  c.ClientIP(),
+			Metas:     metas[g],
+		}
+
+		// 与单个添加相同，归属地不一致的IP提交审批，其余IP正常添加
+		var approvalReq Request
+		var mismatches []string
+		req, approvalReq, mismatches = splitGeoApproval(req)
+		if len(mismatches) > 0 {
+			reason := (&geoMismatchError{Mismatches: mismatches}).Error()
+			approval, err := requestApproval(approvalReq, reason)
+			if err != nil {
+				recordAttempt(approvalReq.newLog(g.merchantName), LogStatusFailed, fmt.Errorf("%s, 提交审批失败: %w", reason, err))
+			} else {
+				recordAttempt(approvalReq.newLog(g.merchantName), LogStatusPending, fmt.Errorf("%s, 已提交审批 %d", reason, approval.ID))
+				approvals = append(approvals, approval.ID)
+			}
+		}
+		if req.WhiteList.IP != "" {
+			submitted += len(splitIPs(req.WhiteList.IP))
+			go whitelistModify(req)
+		}
+	}
+
+	message := fmt.Sprintf("已提交 %d 个IP，请稍后查看结果", submitted)
+	if len(approvals) > 0 {
+		message += fmt.Sprintf("，%d 个商户的部分IP归属地不一致，已提交审批", len(approvals))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    20000,
+		"message": message,
+		"data":    gin.H{"approvalIds": approvals},
+	})
+}
+
+// splitGeoApproval approve 模式下拆出归属地不一致的IP作为待审批的请求，warn 模式只发送提醒
+func splitGeoApproval(req Request) (Request, Request, []string) {
+	approvalReq := req
+	approvalReq.WhiteList.IP, approvalReq.Metas = "", nil
+	if AppConfig.GeoIP.Mode != "approve" {
+		checkGeo(req.WhiteList)
+		return req, approvalReq, nil
+	}
+
+	matched, mismatched, mismatches := make([]string, 0), make(map[string]bool), make([]string, 0)
+	for _, ip := range splitIPs(req.WhiteList.IP) {
+		single := req.WhiteList
+		single.IP = ip
+		if m := geoMismatches(single, req.WhiteList.MerchantName); len(m) > 0 {
+			mismatched[ip] = true
+			mismatches = append(mismatches, m...)
+			approvalReq.WhiteList.IP += ip + "\n"
+		} else {
+			matched = append(matched, ip)
+		}
+	}
+	if len(mismatches) == 0 {
+		return req, approvalReq, nil
+	}
+
+	metas := make([]importMeta, 0)
+	for _, m := range req.Metas {
+		if mismatched[m.IP] {
+			approvalReq.Metas = append(approvalReq.Metas, m)
+		} else {
+			metas = append(metas, m)
+		}
+	}
+	approvalReq.WhiteList.IP = strings.TrimSuffix(approvalReq.WhiteList.IP, "\n")
+	req.WhiteList.IP, req.Metas = strings.Join(matched, "\n"), metas
+	return req, approvalReq, mismatches
+}
+
+// saveImportMetas 保存本次实际添加的IP的备注和过期时间，已有记录时更新
+func saveImportMetas(tx *gorm.DB, merchantName, country, opUser, changedIPs string, metas []importMeta) error {
+	changed := make(map[string]bool)
+	for _, ip := range strings.Split(changedIPs, "\n") {
+		changed[ip] = true
+	}
+
+	for _, m := range metas {
+		ip := normalizeEntry(m.IP)
+		if !changed[ip] {
+			continue
+		}
+		meta := WhiteListIPMeta{MerchantName: merchantName, Country: country, IP: ip}
+		if err := tx.Where("merchant_name = ? AND country = ? AND ip = ?", merchantName, country, ip).Limit(1).Find(&meta).Error; err != nil {
+			return err
+		}
+		meta.Note, meta.ExpiresAt, meta.OpUser = m.Note, m.ExpiresAt, opUser
+		if err := tx.Save(&meta).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	expiringIPs = make(map[uint]bool) // 正在删除的过期IP记录
+	muExpiring  sync.Mutex
+)
+
+// expireWhitelistIPs 定期删除已过期的IP，删除成功时随白名单一起删除记录，失败时下次重试
+func expireWhitelistIPs() {
+	for range time.Tick(time.Minute) {
+		var metas []WhiteListIPMeta
+		if err := DB.Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now()).Find(&metas).Error; err != nil {
+			log.Printf("查询过期IP失败: %v", err)
+			continue
+		}
+
+		for _, meta := range metas {
+			// 已挂起的删除等待计划变更执行
+			var held int64
+			if err := DB.Model(&ScheduledChange{}).Where("status = ? AND source = ? AND action = ? AND merchant_name = ? AND country = ? AND ip = ?",
+				ScheduledPending, SourceExpire, "del", meta.MerchantName, meta.Country, meta.IP).Count(&held).Error; err != nil {
+				log.Printf("查询过期IP的计划变更失败: %v", err)
+				continue
+			}
+
+			muExpiring.Lock()
+			if held > 0 || expiringIPs[meta.ID] {
+				muExpiring.Unlock()
+				continue
+			}
+			expiringIPs[meta.ID] = true
+			muExpiring.Unlock()
+
+			meta := meta
+			go whitelistModify(Request{
+				WhiteList: WhiteList{MerchantName: meta.MerchantName, Country: meta.Country, IP: meta.IP, OpUser: meta.OpUser},
+				Action:    "del",
+				Source:    SourceExpire,
+				Done: func(status string, err error) {
+					switch status {
+					case LogStatusSkipped:
+						// IP 已不在白名单中，不再需要过期
+						if err := DB.Delete(&meta).Error; err != nil {
+							log.Printf("删除过期IP记录失败: %v", err)
+						}
+					case LogStatusFailed, LogStatusRolledBack:
+						log.Printf("删除过期IP %s 失败，稍后重试: %v", meta.IP, err)
+					}
+					muExpiring.Lock()
+					delete(expiringIPs, meta.ID)
+					muExpiring.Unlock()
+				},
+			})
+		}
+	}
+}
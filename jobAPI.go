@@ -0,0 +1,164 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	jobReplies = make(map[uint]func(message string)) // 父任务的回复回调，汇总后回复一次
+	muJobs     sync.Mutex                            // 串行更新父任务的汇总
+)
+
+// startMerchantJob 为每个商户和地区创建子任务并并行执行
+func startMerchantJob(req Request, targets []merchantKey) {
+	job := WhitelistJob{
+		MerchantName: req.WhiteList.MerchantName,
+		Country:      req.WhiteList.Country,
+		IP:           req.WhiteList.IP,
+		Action:       req.Action,
+		OpUser:       req.WhiteList.OpUser,
+		Source:       req.Source,
+		ClientIP:     req.ClientIP,
+		Status:       JobRunning,
+		Total:        len(targets),
+	}
+	for _, target := range targets {
+		job.SubJobs = append(job.SubJobs, WhitelistSubJob{MerchantName: target.MerchantName, Country: target.Country, Status: JobPending})
+	}
+	if err := DB.Create(&job).Error; err != nil {
+		log.Printf("创建批量任务失败: %v", err)
+		recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusFailed, err)
+		req.finish(LogStatusFailed, err)
+		return
+	}
+
+	if req.Reply != nil {
+		muJobs.Lock()
+		jobReplies[job.ID] = req.Reply
+		muJobs.Unlock()
+	}
+	for _, target := range targets {
+		sub := req
+		sub.WhiteList.MerchantName, sub.WhiteList.Country = target.MerchantName, target.Country
+		sub.JobID = job.ID
+		whitelistModify(sub)
+	}
+}
+
+// finishSubJob 记录子任务结果，全部完成后汇总父任务并通知
+func finishSubJob(jobID uint, key merchantKey, status string, err error) {
+	if jobID == 0 {
+		return
+	}
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+
+	muJobs.Lock()
+	defer muJobs.Unlock()
+
+	var job WhitelistJob
+	txErr := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&WhitelistSubJob{}).Where("job_id = ? AND merchant_name = ? AND country = ?", jobID, key.MerchantName, key.Country).
+			Updates(map[string]interface{}{"status": status, "message": message}).Error; err != nil {
+			return err
+		}
+		if err := tx.Preload("SubJobs").First(&job, jobID).Error; err != nil {
+			return err
+		}
+
+		job.Succeeded, job.Failed, job.Skipped = 0, 0, 0
+		pending := 0
+		for _, sub := range job.SubJobs {
+			switch sub.Status {
+			case JobPending:
+				pending++
+			case LogStatusSuccess:
+				job.Succeeded++
+			case LogStatusSkipped, LogStatusCancelled:
+				job.Skipped++
+			default:
+				job.Failed++
+			}
+		}
+		if pending == 0 {
+			switch {
+			case job.Failed == 0:
+				job.Status = JobSuccess
+			case job.Failed == job.Total:
+				job.Status = JobFailed
+			default:
+				job.Status = JobPartial
+			}
+		}
+		return tx.Model(&job).Select("status", "succeeded", "failed", "skipped").Updates(&job).Error
+	})
+	if txErr != nil {
+		log.Printf("更新批量任务 %d 失败: %v", jobID, txErr)
+		return
+	}
+	if job.Status == JobRunning {
+		return
+	}
+
+	failed := make([]string, 0, job.Failed)
+	for _, sub := range job.SubJobs {
+		if sub.Status == LogStatusFailed || sub.Status == LogStatusRolledBack {
+			failed = append(failed, sub.MerchantName+"@"+sub.Country)
+		}
+	}
+	event := NotifyEvent{
+		Type:      EventJobSummary,
+		Country:   job.Country,
+		Merchant:  job.MerchantName,
+		IPs:       splitIPs(job.IP),
+		Action:    job.Action,
+		OpUser:    job.OpUser,
+		Count:     job.Total,
+		Succeeded: job.Succeeded,
+		Failed:    job.Failed,
+		Skipped:   job.Skipped,
+		Error:     strings.Join(failed, ","),
+	}
+	go notify(event)
+	go checkJobNewMerchants(job)
+	if reply, ok := jobReplies[jobID]; ok {
+		delete(jobReplies, jobID)
+		go Request{Reply: reply}.replyEvent(event)
+	}
+}
+
+// whitelistJobs 批量任务列表，可按 status 过滤，传 id 时返回该任务及子任务
+func whitelistJobs(c *gin.Context) {
+	if id, err := strconv.ParseUint(c.DefaultQuery("id", ""), 10, 64); err == nil {
+		var job WhitelistJob
+		if err := DB.Preload("SubJobs").Limit(1).Find(&job, id).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+			return
+		}
+		if job.ID == 0 {
+			c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "任务不存在"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 20000, "data": job})
+		return
+	}
+
+	query := DB.Order("id DESC").Limit(statsLimit(c))
+	if status := c.DefaultQuery("status", ""); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var jobs []WhitelistJob
+	if err := query.Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": jobs})
+}
@@ -2,38 +2,89 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
-const webhookURL = "https://open.larksuite.com/open-apis/bot/v2/hook/2ee21888-8088-463d-ad32-d8ab70c09696"
+var larkClient = &http.Client{Timeout: 10 * time.Second}
 
 type LarkMessage struct {
-	MsgType string `json:"msg_type"`
-	Content struct {
+	Timestamp string `json:"timestamp,omitempty"`
+	Sign      string `json:"sign,omitempty"`
+	MsgType   string `json:"msg_type"`
+	Content   struct {
 		Text string `json:"text"`
 	} `json:"content"`
 }
 
-func SendToLark(message string) {
+// larkResponse 机器人接口的返回
+type larkResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// larkSign 按 Lark 签名校验规则计算签名: 以 timestamp + "\n" + secret 为密钥对空串做 HmacSHA256
+func larkSign(secret string, timestamp int64) (string, error) {
+	stringToSign := fmt.Sprintf("%d\n%s", timestamp, secret)
+	h := hmac.New(sha256.New, []byte(stringToSign))
+	if _, err := h.Write(nil); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// larkBots 获取环境对应的机器人，未配置时使用 default
+func larkBots(env string) []LarkBot {
+	if bots, ok := AppConfig.Lark.Bots[env]; ok && len(bots) > 0 {
+		return bots
+	}
+	return AppConfig.Lark.Bots["default"]
+}
+
+// postToLarkBot 发送文本消息到机器人，配置了密钥时附带签名
+func postToLarkBot(bot LarkBot, message string) error {
 	msg := LarkMessage{
 		MsgType: "text",
 	}
 	msg.Content.Text = message
 
+	if bot.Secret != "" {
+		timestamp := time.Now().Unix()
+		sign, err := larkSign(bot.Secret, timestamp)
+		if err != nil {
+			return fmt.Errorf("计算签名失败: %w", err)
+		}
+		msg.Timestamp = strconv.FormatInt(timestamp, 10)
+		msg.Sign = sign
+	}
+
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Println("序列化消息失败:", err)
+		return fmt.Errorf("序列化消息失败: %w", err)
 	}
 
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(data))
+	resp, err := larkClient.Post(bot.WebhookURL, "application/json", bytes.NewBuffer(data))
 	if err != nil {
-		log.Println("发送消息到lark失败:", err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Println("发送消息到lark失败, 错误代码:", resp.StatusCode)
+		return fmt.Errorf("错误代码: %d", resp.StatusCode)
+	}
+
+	var res larkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("解析返回失败: %w", err)
+	}
+	if res.Code != 0 {
+		return fmt.Errorf("错误代码: %d, %s", res.Code, res.Msg)
 	}
+	return nil
 }
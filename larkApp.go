@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// larkTenantToken 缓存的 tenant_access_token
+var larkTenantToken struct {
+	sync.Mutex
+	token    string
+	expireAt time.Time
+}
+
+// larkAPIResponse 开放平台接口的通用返回
+type larkAPIResponse struct {
+	Code int             `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+// larkAccessToken 获取 tenant_access_token，提前 5 分钟刷新
+func larkAccessToken() (string, error) {
+	larkTenantToken.Lock()
+	defer larkTenantToken.Unlock()
+
+	if larkTenantToken.token != "" && time.Now().Before(larkTenantToken.expireAt) {
+		return larkTenantToken.token, nil
+	}
+
+	app := AppConfig.Lark.App
+	if app.AppID == "" || app.AppSecret == "" {
+		return "", fmt.Errorf("未配置 Lark 应用")
+	}
+
+	body, _ := json.Marshal(map[string]string{"app_id": app.AppID, "app_secret": app.AppSecret})
+	resp, err := larkClient.Post(app.BaseURL+"/open-apis/auth/v3/tenant_access_token/internal", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Code              int    `json:"code"`
+		Msg               string `json:"msg"`
+		TenantAccessToken string `json:"tenant_access_token"`
+		Expire            int    `json:"expire"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("解析 token 返回失败: %w", err)
+	}
+	if res.Code != 0 {
+		return "", fmt.Errorf("获取 token 失败: %d, %s", res.Code, res.Msg)
+	}
+
+	larkTenantToken.token = res.TenantAccessToken
+	larkTenantToken.expireAt = time.Now().Add(time.Duration(res.Expire)*time.Second - 5*time.Minute)
+	return larkTenantToken.token, nil
+}
+
+// larkAPI 调用开放平台接口，out 为 data 字段的解析目标
+func larkAPI(method, path string, payload any, out any) error {
+	token, err := larkAccessToken()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, AppConfig.Lark.App.BaseURL+path, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := larkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res larkAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("解析返回失败: %w", err)
+	}
+	if res.Code != 0 {
+		return fmt.Errorf("调用 %s 失败: %d, %s", path, res.Code, res.Msg)
+	}
+	if out != nil && len(res.Data) > 0 {
+		return json.Unmarshal(res.Data, out)
+	}
+	return nil
+}
+
+// textContent 构造文本消息的 content 字段
+func textContent(text string) string {
+	content, _ := json.Marshal(map[string]string{"text": text})
+	return string(content)
+}
+
+// replyLarkMessage 在话题中回复消息
+func replyLarkMessage(messageID, text string) error {
+	payload := map[string]any{
+		"msg_type":        "text",
+		"content":         textContent(text),
+		"reply_in_thread": true,
+	}
+	return larkAPI(http.MethodPost, "/open-apis/im/v1/messages/"+messageID+"/reply", payload, nil)
+}
+
+// larkDecrypt 解密加密推送的事件
+func larkDecrypt(encrypt, key string) ([]byte, error) {
+	buf, err := base64.StdEncoding.DecodeString(encrypt)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < aes.BlockSize || len(buf)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("密文长度错误")
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	iv, data := buf[:aes.BlockSize], buf[aes.BlockSize:]
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	// 去掉 PKCS7 填充
+	if n := len(data); n > 0 {
+		pad := int(data[n-1])
+		if pad > 0 && pad <= aes.BlockSize && pad <= n {
+			data = data[:n-pad]
+		}
+	}
+	return []byte(strings.TrimSpace(string(data))), nil
+}
+
+// larkVerifySignature 校验事件推送的签名: sha256(timestamp + nonce + encryptKey + body) 的十六进制
+func larkVerifySignature(timestamp, nonce, key, signature string, body []byte) bool {
+	if signature == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(timestamp + nonce + key + string(body)))
+	return hmac.Equal([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(signature)))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const larkCommandUsage = `用法:
+/whitelist add <国家[,国家]|all> <商户[,商户]> <IP> [IP...]
+/whitelist del <国家[,国家]|all> <商户[,商户]> <IP> [IP...]
+/whitelist show <商户>`
+
+// larkEventBody 事件订阅推送的内容
+type larkEventBody struct {
+	Encrypt   string `json:"encrypt"`
+	Challenge string `json:"challenge"`
+	Token     string `json:"token"`
+	Type      string `json:"type"`
+	Header    struct {
+		EventID   string `json:"event_id"`
+		EventType string `json:"event_type"`
+		Token     string `json:"token"`
+	} `json:"header"`
+	Event struct {
+		Sender struct {
+			SenderID struct {
+				OpenID string `json:"open_id"`
+			} `json:"sender_id"`
+		} `json:"sender"`
+		Message struct {
+			MessageID   string `json:"message_id"`
+			MessageType string `json:"message_type"`
+			Content     string `json:"content"`
+		} `json:"message"`
+	} `json:"event"`
+}
+
+var (
+	larkEvents   = make(map[string]bool) // 已处理的事件，Lark 会重复推送
+	muLarkEvents sync.Mutex
+)
+
+// markLarkEvent 记录事件，已处理过返回 false
+func markLarkEvent(eventID string) bool {
+	muLarkEvents.Lock()
+	defer muLarkEvents.Unlock()
+
+	if larkEvents[eventID] {
+		return false
+	}
+	larkEvents[eventID] = true
+	go func() {
+		time.Sleep(10 * time.Minute)
+		muLarkEvents.Lock()
+		delete(larkEvents, eventID)
+		muLarkEvents.Unlock()
+	}()
+	return true
+}
+
+// larkEvent Lark 事件订阅入口
+func larkEvent(c *gin.Context) {
+	app := AppConfig.Lark.App
+	if app.VerificationToken == "" && app.EncryptKey == "" {
+		// 未配置校验方式时无法确认推送来自 Lark，拒绝处理
+		log.Printf("未配置 Lark verificationToken 或 encryptKey，拒绝事件推送")
+		c.JSON(http.StatusForbidden, gin.H{"code": 40001, "message": "未配置事件校验"})
+		return
+	}
+
+	raw, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 40000, "message": "格式错误"})
+		return
+	}
+	var body larkEventBody
+	if err := json.Unmarshal(raw, &body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 40000, "message": "格式错误"})
+		return
+	}
+
+	if app.EncryptKey != "" {
+		// 配置了 Encrypt Key 时推送都是加密的
+		if body.Encrypt == "" {
+			c.JSON(http.StatusForbidden, gin.H{"code": 40001, "message": "事件未加密"})
+			return
+		}
+		data, err := larkDecrypt(body.Encrypt, app.EncryptKey)
+		if err == nil {
+			body = larkEventBody{}
+			err = json.Unmarshal(data, &body)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 40000, "message": "解密失败"})
+			return
+		}
+
+		// URL 校验请求不带签名，能用 Encrypt Key 解密即可
+		if body.Type != "url_verification" && !larkVerifySignature(c.GetHeader("X-Lark-Request-Timestamp"),
+			c.GetHeader("X-Lark-Request-Nonce"), app.EncryptKey, c.GetHeader("X-Lark-Signature"), raw) {
+			c.JSON(http.StatusForbidden, gin.H{"code": 40001, "message": "签名校验失败"})
+			return
+		}
+	}
+
+	token := body.Token
+	if token == "" {
+		token = body.Header.Token
+	}
+	if app.VerificationToken != "" && token != app.VerificationToken {
+		c.JSON(http.StatusForbidden, gin.H{"code": 40001, "message": "token 校验失败"})
+		return
+	}
+
+	if body.Type == "url_verification" {
+		c.JSON(http.StatusOK, gin.H{"challenge": body.Challenge})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 0})
+
+	if body.Header.EventType != "im.message.receive_v1" || body.Event.Message.MessageType != "text" {
+		return
+	}
+	if !markLarkEvent(body.Header.EventID) {
+		return
+	}
+
+	var content struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(body.Event.Message.Content), &content); err != nil {
+		log.Printf("解析 Lark 消息失败: %v", err)
+		return
+	}
+
+	go handleLarkCommand(body.Event.Sender.SenderID.OpenID, body.Event.Message.MessageID, content.Text)
+}
+
+// handleLarkCommand 处理机器人指令
+func handleLarkCommand(openID, messageID, text string) {
+	reply := func(message string) {
+		if err := replyLarkMessage(messageID, message); err != nil {
+			log.Printf("回复 Lark 消息失败: %v", err)
+		}
+	}
+
+	// 去掉 @机器人 的占位符
+	fields := make([]string, 0)
+	for _, field := range strings.Fields(text) {
+		if !strings.HasPrefix(field, "@_user_") {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 || fields[0] != "/whitelist" {
+		return
+	}
+
+	var user User
+	if err := DB.Where("lark_open_id = ?", openID).First(&user).Error; err != nil || openID == "" {
+		reply("您的 Lark 账号未绑定系统用户，权限被拒绝")
+		return
+	}
+
+	if len(fields) < 2 {
+		reply(larkCommandUsage)
+		return
+	}
+
+	switch action := fields[1]; action {
+	case "show":
+		if len(fields) < 3 {
+			reply(larkCommandUsage)
+			return
+		}
+		reply(whitelistShowText(fields[2]))
+	case "add", "del":
+		if len(fields) < 5 {
+			reply(larkCommandUsage)
+			return
+		}
+		if !contains(AppConfig.Lark.App.ModifyRoles, user.Role) {
+			reply(fmt.Sprintf("用户 %s 无权%s白名单", user.Username, actionText(action)))
+			return
+		}
+
+		ips := strings.FieldsFunc(strings.Join(fields[4:], ","), func(r rune) bool { return r == ',' })
+		whiteList := WhiteList{
+			Country:      fields[2],
+			MerchantName: fields[3],
+			IP:           strings.Join(ips, "\n"),
+			OpUser:       user.Username,
+		}
+		req := Request{WhiteList: whiteList, Action: action, Source: SourceChat, Reply: reply}
+		if err := validateWhiteList(whiteList, action); err != nil {
+			recordAttempt(req.newLog(whiteList.MerchantName), LogStatusFailed, err)
+			reply(err.Error())
+			return
+		}
+
+		reply(fmt.Sprintf("正在%s白名单，请稍后查看结果", actionText(action)))
+		go whitelistModify(req)
+	default:
+		reply(larkCommandUsage)
+	}
+}
+
+// whitelistShowText 商户白名单的文本描述
+func whitelistShowText(merchantName string) string {
+	var whiteLists []WhiteList
+	if err := DB.Where("merchant_name = ?", merchantName).Find(&whiteLists).Error; err != nil {
+		return fmt.Sprintf("查询数据库失败: %v", err)
+	}
+	if len(whiteLists) == 0 {
+		return fmt.Sprintf("商户 %s 不存在", merchantName)
+	}
+
+	var sb strings.Builder
+	for _, whiteList := range whiteLists {
+		fmt.Fprintf(&sb, "%s 商户 %s 白名单IP:\n%s\n", whiteList.Country, whiteList.MerchantName, whiteList.IP)
+	}
+	return strings.TrimSpace(sb.String())
+}
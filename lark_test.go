@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// larkStub 本地模拟的机器人接口，按路径记录收到的消息
+type larkStub struct {
+	mu       sync.Mutex
+	received map[string][]LarkMessage
+}
+
+func newLarkStub(t *testing.T) (*larkStub, *httptest.Server) {
+	stub := &larkStub{received: make(map[string][]LarkMessage)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg LarkMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("解析消息失败: %v", err)
+		}
+		stub.mu.Lock()
+		stub.received[r.URL.Path] = append(stub.received[r.URL.Path], msg)
+		stub.mu.Unlock()
+		w.Write([]byte(`{"code":0,"msg":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	return stub, server
+}
+
+func (s *larkStub) messages(path string) []LarkMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received[path]
+}
+
+func TestPostToLarkBotSign(t *testing.T) {
+	stub, server := newLarkStub(t)
+
+	bot := LarkBot{Name: "signed", WebhookURL: server.URL + "/signed", Secret: "s3cr3t"}
+	before := time.Now().Unix()
+	if err := postToLarkBot(bot, "hello"); err != nil {
+		t.Fatalf("发送失败: %v", err)
+	}
+	after := time.Now().Unix()
+
+	msgs := stub.messages("/signed")
+	if len(msgs) != 1 {
+		t.Fatalf("收到 %d 条消息, 期望 1 条", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.Content.Text != "hello" || msg.MsgType != "text" {
+		t.Errorf("消息内容错误: %+v", msg)
+	}
+
+	timestamp, err := strconv.ParseInt(msg.Timestamp, 10, 64)
+	if err != nil {
+		t.Fatalf("timestamp %q 不是秒级时间戳: %v", msg.Timestamp, err)
+	}
+	if timestamp < before || timestamp > after {
+		t.Errorf("timestamp %d 不在 [%d, %d] 内", timestamp, before, after)
+	}
+
+	h := hmac.New(sha256.New, []byte(msg.Timestamp+"\n"+bot.Secret))
+	want := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if msg.Sign != want {
+		t.Errorf("sign = %q, 期望 %q", msg.Sign, want)
+	}
+}
+
+func TestPostToLarkBotUnsigned(t *testing.T) {
+	stub, server := newLarkStub(t)
+
+	if err := postToLarkBot(LarkBot{Name: "plain", WebhookURL: server.URL + "/plain"}, "hello"); err != nil {
+		t.Fatalf("发送失败: %v", err)
+	}
+	msgs := stub.messages("/plain")
+	if len(msgs) != 1 {
+		t.Fatalf("收到 %d 条消息, 期望 1 条", len(msgs))
+	}
+	if msgs[0].Timestamp != "" || msgs[0].Sign != "" {
+		t.Errorf("未配置密钥时不应签名: %+v", msgs[0])
+	}
+}
+
+func TestPostToLarkBotError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code":19021,"msg":"sign match fail or timestamp is not within one hour from current time"}`))
+	}))
+	defer server.Close()
+
+	if err := postToLarkBot(LarkBot{WebhookURL: server.URL, Secret: "wrong"}, "hello"); err == nil {
+		t.Error("机器人返回错误码时应返回错误")
+	}
+}
+
+func TestDeliverNotifyRoutesByEnv(t *testing.T) {
+	stub, server := newLarkStub(t)
+
+	bots := AppConfig.Lark.Bots
+	defer func() { AppConfig.Lark.Bots = bots }()
+	AppConfig.Lark.Bots = map[string][]LarkBot{
+		"default": {{Name: "default", WebhookURL: server.URL + "/default"}},
+		"br": {
+			{Name: "br-ops", WebhookURL: server.URL + "/br-ops", Secret: "br"},
+			{Name: "br-dev", WebhookURL: server.URL + "/br-dev"},
+		},
+		"pk": {{Name: "pk-ops", WebhookURL: server.URL + "/pk-ops", Secret: "pk"}},
+	}
+
+	tests := []struct {
+		env  string
+		want []string
+	}{
+		{"br", []string{"/br-ops", "/br-dev"}},
+		{"pk", []string{"/pk-ops"}},
+		{"vn", []string{"/default"}},
+	}
+	for _, tt := range tests {
+		before := make(map[string]int)
+		for _, path := range []string{"/default", "/br-ops", "/br-dev", "/pk-ops"} {
+			before[path] = len(stub.messages(path))
+		}
+
+		deliverNotify(NotifyEvent{Type: EventIPAdded, Country: tt.env, Merchant: "m1", IPs: []string{"1.1.1.1"}, OpUser: "alice"})
+
+		for path, n := range before {
+			got := len(stub.messages(path)) - n
+			want := 0
+			if contains(tt.want, path) {
+				want = 1
+			}
+			if got != want {
+				t.Errorf("env %s: %s 收到 %d 条消息, 期望 %d 条", tt.env, path, got, want)
+			}
+		}
+	}
+}
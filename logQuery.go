@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logSortFields 允许排序的字段
+var logSortFields = map[string]bool{
+	"created_at":    true,
+	"merchant_name": true,
+	"op_user":       true,
+	"act":           true,
+	"country":       true,
+	"status":        true,
+}
+
+// logTimeLayouts 时间参数支持的格式，按上海时区解析
+var logTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// logQuery 操作日志的查询条件，列表、统计和导出共用
+type logQuery struct {
+	IP           string
+	OpUser       string
+	MerchantName string
+	Act          string
+	Country      string
+	Status       string
+	Exact        bool // 精确匹配，默认模糊匹配
+	Start        time.Time
+	End          time.Time
+	Prefix       netip.Prefix // IP 为网段时按包含关系查询
+	Sort         string
+	Desc         bool
+	Cursor       uint // 按 id 翻页，仅按 created_at 排序时有效
+
+	ids []uint // 网段查询命中的日志
+}
+
+// parseLogTime 解析时间参数
+func parseLogTime(value string) (time.Time, error) {
+	for _, layout := range logTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("时间格式错误: %s", value)
+}
+
+// parseLogQuery 从请求参数解析查询条件
+func parseLogQuery(c *gin.Context) (logQuery, error) {
+	q := logQuery{
+		IP:           strings.TrimSpace(c.DefaultQuery("Ip", "")),
+		OpUser:       c.DefaultQuery("OpUser", ""),
+		MerchantName: c.DefaultQuery("MerchantNumber", ""),
+		Act:          c.DefaultQuery("Act", ""),
+		Country:      c.DefaultQuery("Country", ""),
+		Status:       c.DefaultQuery("Status", ""),
+		Exact:        c.DefaultQuery("mode", "fuzzy") == "exact",
+		Sort:         c.DefaultQuery("sort", "created_at"),
+		Desc:         c.DefaultQuery("order", "desc") != "asc",
+	}
+
+	if !logSortFields[q.Sort] {
+		return q, fmt.Errorf("不支持的排序字段: %s", q.Sort)
+	}
+
+	var err error
+	if start := c.DefaultQuery("startTime", ""); start != "" {
+		if q.Start, err = parseLogTime(start); err != nil {
+			return q, err
+		}
+	}
+	if end := c.DefaultQuery("endTime", ""); end != "" {
+		if q.End, err = parseLogTime(end); err != nil {
+			return q, err
+		}
+		// 只有日期时包含当天
+		if len(end) == len("2006-01-02") {
+			q.End = q.End.AddDate(0, 0, 1)
+		}
+	}
+
+	if strings.Contains(q.IP, "/") {
+		if q.Prefix, err = netip.ParsePrefix(q.IP); err != nil {
+			return q, fmt.Errorf("网段格式错误: %s", q.IP)
+		}
+		q.Prefix = q.Prefix.Masked()
+	}
+
+	if cursor := c.DefaultQuery("cursor", ""); cursor != "" {
+		value, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("cursor 格式错误")
+		}
+		if q.Sort != "created_at" {
+			return q, fmt.Errorf("cursor 翻页仅支持按 created_at 排序")
+		}
+		q.Cursor = uint(value)
+	}
+	return q, nil
+}
+
+// match 文本字段的精确或模糊匹配
+func (q logQuery) match(db *gorm.DB, column, value string) *gorm.DB {
+	if value == "" {
+		return db
+	}
+	if q.Exact {
+		return db.Where(column+" = ?", value)
+	}
+	return db.Where(column+" LIKE ?", "%"+value+"%")
+}
+
+// where 查询条件，不含排序和翻页
+func (q logQuery) where(db *gorm.DB) *gorm.DB {
+	switch {
+	case q.Prefix.IsValid():
+		db = db.Where(idInClause(q.ids))
+	case q.IP != "" && q.Exact:
+		// IP 字段为换行分隔的列表，精确匹配其中一行
+		db = db.Where("(char(10) || ip || char(10)) LIKE ?", "%\n"+q.IP+"\n%")
+	case q.IP != "":
+		db = db.Where("ip LIKE ?", "%"+q.IP+"%")
+	}
+
+	db = q.match(db, "op_user", q.OpUser)
+	db = q.match(db, "merchant_name", q.MerchantName)
+
+	if q.Act != "" {
+		db = db.Where("act = ?", q.Act)
+	}
+	if q.Country != "" {
+		db = db.Where("country = ?", q.Country)
+	}
+	if q.Status != "" {
+		db = db.Where("status = ?", q.Status)
+	}
+	if !q.Start.IsZero() {
+		db = db.Where("created_at >= ?", q.Start)
+	}
+	if !q.End.IsZero() {
+		db = db.Where("created_at < ?", q.End)
+	}
+	return db
+}
+
+// order 排序，相同值按 id 保证稳定
+func (q logQuery) order(db *gorm.DB) *gorm.DB {
+	direction := "ASC"
+	if q.Desc {
+		direction = "DESC"
+	}
+	return db.Order(fmt.Sprintf("%s %s, id %s", q.Sort, direction, direction))
+}
+
+// page 基于 cursor 或 offset 翻页
+func (q logQuery) page(db *gorm.DB, offset, limit int) *gorm.DB {
+	if q.Cursor == 0 {
+		return db.Offset(offset).Limit(limit)
+	}
+	if q.Desc {
+		return db.Where("id < ?", q.Cursor).Limit(limit)
+	}
+	return db.Where("id > ?", q.Cursor).Limit(limit)
+}
+
+// ipsInPrefix 换行分隔的IP列表中是否有落在网段内的IP或网段
+func ipsInPrefix(ipList string, prefix netip.Prefix) bool {
+	for _, ip := range strings.Split(ipList, "\n") {
+		ip = strings.TrimSpace(ip)
+		if p, err := netip.ParsePrefix(ip); err == nil {
+			if prefix.Overlaps(p) {
+				return true
+			}
+			continue
+		}
+		if addr, err := netip.ParseAddr(ip); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// idInClause 按 id 列表过滤，id 直接写入 SQL，命中很多日志时不受绑定参数个数的限制
+func idInClause(ids []uint) string {
+	if len(ids) == 0 {
+		return "1 = 0"
+	}
+	var sb strings.Builder
+	sb.WriteString("id IN (")
+	for i, id := range ids {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatUint(uint64(id), 10))
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
+
+// resolve 网段查询无法用 SQL 表达，先按其余条件筛选再逐条判断包含关系
+func (q *logQuery) resolve(db *gorm.DB) error {
+	if !q.Prefix.IsValid() {
+		return nil
+	}
+
+	base := *q
+	base.IP, base.Prefix = "", netip.Prefix{}
+
+	rows, err := base.where(db.Table("whitelist_logs").Select("id, ip")).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	q.ids = make([]uint, 0)
+	for rows.Next() {
+		var id uint
+		var ip string
+		if err := rows.Scan(&id, &ip); err != nil {
+			return err
+		}
+		if ipsInPrefix(ip, q.Prefix) {
+			q.ids = append(q.ids, id)
+		}
+	}
+	return rows.Err()
+}
+
+// matchText 与 match 相同的文本匹配，LIKE 不区分大小写
+func (q logQuery) matchText(value, want string) bool {
+	if want == "" {
+		return true
+	}
+	if q.Exact {
+		return value == want
+	}
+	return strings.Contains(strings.ToLower(value), strings.ToLower(want))
+}
+
+// matches 在内存中按 where 相同的条件判断，用于查询归档的日志
+func (q logQuery) matches(l WhitelistLog) bool {
+	switch {
+	case q.Prefix.IsValid():
+		if !ipsInPrefix(l.IP, q.Prefix) {
+			return false
+		}
+	case q.IP != "" && q.Exact:
+		if !strings.Contains("\n"+l.IP+"\n", "\n"+q.IP+"\n") {
+			return false
+		}
+	case !q.matchText(l.IP, q.IP):
+		return false
+	}
+
+	if !q.matchText(l.OpUser, q.OpUser) || !q.matchText(l.MerchantName, q.MerchantName) {
+		return false
+	}
+	if (q.Act != "" && l.Act != q.Act) || (q.Country != "" && l.Country != q.Country) || (q.Status != "" && l.Status != q.Status) {
+		return false
+	}
+	if !q.Start.IsZero() && l.CreatedAt.Before(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && !l.CreatedAt.Before(q.End) {
+		return false
+	}
+	return true
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"log"
+	"os"
 	"time"
 )
 
 var DB *gorm.DB
 var ERR error
 
+const databaseDSN = "gorm.db?parseTime=true&loc=Asia%2FShanghai"
+
 func init() {
 	// 设置时区为上海时区
 	loc, err := time.LoadLocation("Asia/Shanghai")
@@ -21,23 +25,66 @@ func init() {
 	log.Println("Current time in Shanghai:", now)
 	time.Local = loc
 
-	// 初始化数据库
-	dsn := "gorm.db?parseTime=true&loc=Asia%2FShanghai"
-	DB, ERR = gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	// 加载配置
+	AppConfig, ERR = loadConfig(configPath())
+	if ERR != nil {
+		log.Fatal(ERR.Error())
+	}
+	notifyTemplates, ERR = loadNotifyTemplates(AppConfig.Notify.TemplateDir)
+	if ERR != nil {
+		log.Fatal("failed to load templates: ", ERR)
+	}
+	ipPolicies, ERR = loadIPPolicies(AppConfig.Policy)
 	if ERR != nil {
+		log.Fatal("failed to load ip policies: ", ERR)
+	}
+	if ERR = openGeoIP(AppConfig.GeoIP); ERR != nil {
 		log.Fatal(ERR.Error())
 	}
+	initWorkerPool()
+}
+
+// openDatabase 打开数据库并迁移表结构
+func openDatabase(dsn string) error {
+	var err error
+	DB, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return err
+	}
 
 	// 自动迁移模式
-	ERR = DB.AutoMigrate(&User{}, &WhiteList{}, &WhitelistLog{})
-	if ERR != nil {
-		log.Fatal("failed to migrate database: ", ERR)
+	err = DB.AutoMigrate(&User{}, &WhiteList{}, &WhitelistLog{}, &WhiteListIPMeta{}, &LogArchive{}, &LogChainSeal{}, &WhitelistVersion{}, &WhitelistApproval{}, &ScheduledChange{}, &WhitelistJob{}, &WhitelistSubJob{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
 	}
 
-	go handleLarkMessages()
+	// 为升级前的日志补齐哈希链，只执行一次
+	if err = sealWhitelistLogs(); err != nil {
+		return fmt.Errorf("failed to seal whitelist logs: %w", err)
+	}
+	return nil
 }
 
 func main() {
+	// 带参数时执行子命令，不启动后台任务，避免与运行中的服务同时归档或执行定时变更
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	// 初始化数据库
+	if err := openDatabase(databaseDSN); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	go handleLarkMessages()
+	go expireWhitelistIPs()
+	go runLogRetention()
+	go runScheduledChanges()
+	go probeServers()
+	go backfillGeoInfo()
 
 	router := gin.Default()
 	router.Use(CORSMiddleware())
@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
@@ -30,6 +31,13 @@ func ValidateWhiteListIPs(whiteList WhiteList) error {
 	ips := strings.Split(whiteList.IP, "\n")
 	for _, ip := range ips {
 		ip = strings.TrimSpace(ip)
+		// 支持网段
+		if strings.Contains(ip, "/") {
+			if _, err := netip.ParsePrefix(ip); err != nil {
+				return fmt.Errorf("invalid CIDR: %s", ip)
+			}
+			continue
+		}
 		if net.ParseIP(ip) == nil {
 			return fmt.Errorf("invalid IP address: %s", ip)
 		}
@@ -38,7 +46,7 @@ func ValidateWhiteListIPs(whiteList WhiteList) error {
 }
 
 func handleLarkMessages() {
-	for msg := range larkChannel {
-		SendToLark(msg)
+	for event := range larkChannel {
+		deliverNotify(event)
 	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// 通知事件类型，对应 templates/<语言>/<事件>.tmpl
+const (
+	EventIPAdded        = "ip_added"
+	EventIPRemoved      = "ip_removed"
+	EventIPDuplicate    = "ip_duplicate"
+	EventIPMissing      = "ip_missing"
+	EventIPUnchanged    = "ip_unchanged"
+	EventJobFailed      = "job_failed"
+	EventCommandTimeout = "command_timeout"
+	EventMassDelete     = "mass_delete"
+	EventOffHours       = "off_hours"
+	EventNewMerchant    = "new_merchant"
+	EventQuotaWarning   = "quota_warning"
+	EventGeoMismatch    = "geo_mismatch"
+	EventChangeHeld     = "change_held"
+	EventJobCancelled   = "job_cancelled"
+	EventServerDown     = "server_down"
+	EventServerUp       = "server_up"
+	EventJobSummary     = "job_summary"
+)
+
+// failureEvents 需要 @操作用户 的失败事件
+var failureEvents = map[string]bool{
+	EventIPDuplicate: true,
+	EventIPMissing:   true,
+	EventJobFailed:   true,
+}
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+var notifyFuncs = template.FuncMap{"join": strings.Join}
+
+// notifyTemplates 按语言加载的消息模板
+var notifyTemplates map[string]*template.Template
+
+// NotifyEvent 通知事件
+type NotifyEvent struct {
+	Type     string
+	Country  string
+	Merchant string
+	IPs      []string
+	Action   string
+	OpUser   string
+	Server   string
+	Error    string
+	Count    int    // 批量删除的IP数
+	Minutes  int    // 批量删除的时间窗口
+	Time     string // 操作时间
+	Quota    int    // 商户的条目上限
+	Percent  int    // 配额使用的百分比
+	// 多商户任务的汇总，Count 为商户总数
+	Succeeded int
+	Failed    int
+	Skipped   int
+}
+
+// notifyData 模板渲染数据
+type notifyData struct {
+	NotifyEvent
+	Mention string
+}
+
+// loadNotifyTemplates 加载消息模板，配置了模板目录时优先使用目录中的模板
+func loadNotifyTemplates(dir string) (map[string]*template.Template, error) {
+	var fsys fs.FS
+	if dir != "" {
+		fsys = os.DirFS(dir)
+	} else {
+		sub, err := fs.Sub(embeddedTemplates, "templates")
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	}
+
+	locales, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("读取模板目录失败: %w", err)
+	}
+
+	templates := make(map[string]*template.Template)
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+		tmpl, err := template.New(locale.Name()).Funcs(notifyFuncs).ParseFS(fsys, locale.Name()+"/*.tmpl")
+		if err != nil {
+			return nil, fmt.Errorf("解析 %s 模板失败: %w", locale.Name(), err)
+		}
+		templates[locale.Name()] = tmpl
+	}
+
+	if _, ok := templates[AppConfig.Notify.DefaultLocale]; !ok {
+		return nil, fmt.Errorf("缺少默认语言 %s 的模板", AppConfig.Notify.DefaultLocale)
+	}
+	return templates, nil
+}
+
+// renderNotify 渲染事件消息，locale 为空或不存在时使用默认语言，mention 为操作用户的展示方式
+func renderNotify(event NotifyEvent, locale, mention string) (string, error) {
+	tmpl, ok := notifyTemplates[locale]
+	if !ok {
+		tmpl = notifyTemplates[AppConfig.Notify.DefaultLocale]
+	}
+
+	var sb strings.Builder
+	data := notifyData{NotifyEvent: event, Mention: mention}
+	if err := tmpl.ExecuteTemplate(&sb, event.Type+".tmpl", data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// notify 发送事件通知
+func notify(event NotifyEvent) {
+	larkChannel <- event
+}
+
+// deliverNotify 按机器人的语言渲染并投递通知，失败事件 @操作用户，开启私信的用户同时私信
+func deliverNotify(event NotifyEvent) {
+	mention := event.OpUser
+
+	var user User
+	if failureEvents[event.Type] && event.OpUser != "" {
+		if err := DB.Where("username = ?", event.OpUser).First(&user).Error; err == nil {
+			if openID := larkOpenID(&user); openID != "" {
+				mention = fmt.Sprintf(`<at user_id="%s">%s</at>`, openID, user.Username)
+			}
+		}
+	}
+
+	for _, bot := range larkBots(event.Country) {
+		text, err := renderNotify(event, bot.Locale, mention)
+		if err != nil {
+			log.Printf("渲染通知失败: %v", err)
+			continue
+		}
+		if err := postToLarkBot(bot, text); err != nil {
+			log.Printf("发送消息到lark机器人 %s 失败: %v", bot.Name, err)
+		}
+	}
+
+	if !user.LarkDM {
+		return
+	}
+	text, err := renderNotify(event, AppConfig.Lark.App.Locale, user.Username)
+	if err != nil {
+		log.Printf("渲染通知失败: %v", err)
+		return
+	}
+	if err := sendLarkDirect(&user, text); err != nil {
+		log.Printf("私信用户 %s 失败: %v", user.Username, err)
+	}
+}
+
+// larkOpenID 获取用户的 open_id，只绑定了邮箱时通过通讯录查询并保存
+func larkOpenID(user *User) string {
+	if user.LarkOpenID != "" || user.LarkEmail == "" {
+		return user.LarkOpenID
+	}
+
+	var data struct {
+		UserList []struct {
+			Email  string `json:"email"`
+			UserID string `json:"user_id"`
+		} `json:"user_list"`
+	}
+	payload := map[string][]string{"emails": {user.LarkEmail}}
+	if err := larkAPI(http.MethodPost, "/open-apis/contact/v3/users/batch_get_id?user_id_type=open_id", payload, &data); err != nil {
+		log.Printf("查询用户 %s 的 open_id 失败: %v", user.Username, err)
+		return ""
+	}
+
+	for _, item := range data.UserList {
+		if item.UserID != "" {
+			user.LarkOpenID = item.UserID
+			DB.Model(&User{}).Where("username = ?", user.Username).Update("lark_open_id", item.UserID)
+			break
+		}
+	}
+	return user.LarkOpenID
+}
+
+// sendLarkDirect 私信用户，优先使用 open_id
+func sendLarkDirect(user *User, text string) error {
+	receiveIDType, receiveID := "open_id", user.LarkOpenID
+	if receiveID == "" {
+		receiveIDType, receiveID = "email", user.LarkEmail
+	}
+	if receiveID == "" {
+		return fmt.Errorf("未绑定 Lark 账号")
+	}
+
+	payload := map[string]string{
+		"receive_id": receiveID,
+		"msg_type":   "text",
+		"content":    textContent(text),
+	}
+	return larkAPI(http.MethodPost, "/open-apis/im/v1/messages?receive_id_type="+receiveIDType, payload, nil)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// policyRange 规则禁止的一类地址
+type policyRange struct {
+	reason   string
+	enabled  func(cfg PolicyConfig) bool
+	prefixes []netip.Prefix
+}
+
+// policyRanges 内置的保留地址，网段与其重叠即拒绝
+var policyRanges = []policyRange{
+	{"未指定地址", func(cfg PolicyConfig) bool { return cfg.DenyUnspecified }, mustPrefixes("0.0.0.0/32", "::/128")},
+	{"回环地址", func(cfg PolicyConfig) bool { return cfg.DenyLoopback }, mustPrefixes("127.0.0.0/8", "::1/128")},
+	{"私有地址", func(cfg PolicyConfig) bool { return cfg.DenyPrivate }, mustPrefixes("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")},
+	{"链路本地地址", func(cfg PolicyConfig) bool { return cfg.DenyLinkLocal }, mustPrefixes("169.254.0.0/16", "fe80::/10")},
+	{"组播地址", func(cfg PolicyConfig) bool { return cfg.DenyMulticast }, mustPrefixes("224.0.0.0/4", "ff00::/8")},
+}
+
+// ipPolicy 编译后的地区规则
+type ipPolicy struct {
+	PolicyConfig
+	deny    []netip.Prefix
+	trusted []netip.Prefix
+}
+
+// ipPolicies 按地区的规则，启动时加载
+var ipPolicies map[string]*ipPolicy
+
+// policyRejection 单个IP被拒绝的原因
+type policyRejection struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+}
+
+// policyError 不符合规则的IP
+type policyError struct {
+	Rejections []policyRejection
+}
+
+func (e *policyError) Error() string {
+	reasons := make([]string, 0, len(e.Rejections))
+	for _, r := range e.Rejections {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", r.IP, r.Reason))
+	}
+	return "IP不符合规则, " + strings.Join(reasons, "; ")
+}
+
+func mustPrefixes(values ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefixes = append(prefixes, netip.MustParsePrefix(value))
+	}
+	return prefixes
+}
+
+// parseEntryPrefix 解析IP或网段，单个IP视为 /32 或 /128，IPv4 映射地址转换为 IPv4
+func parseEntryPrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return prefix, err
+		}
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96).Masked(), nil
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// loadTrustedRanges 读取可信网段文件
+func loadTrustedRanges(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	prefixes := make([]netip.Prefix, 0)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		prefix, err := parseEntryPrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s 第 %d 行格式错误: %w", path, line, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, scanner.Err()
+}
+
+// loadIPPolicies 编译各地区的规则
+func loadIPPolicies(configs map[string]PolicyConfig) (map[string]*ipPolicy, error) {
+	policies := make(map[string]*ipPolicy, len(configs))
+	for country, cfg := range configs {
+		policy := &ipPolicy{PolicyConfig: cfg}
+		for _, entry := range cfg.Deny {
+			prefix, err := parseEntryPrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("地区 %s 的禁止列表格式错误: %s", country, entry)
+			}
+			policy.deny = append(policy.deny, prefix)
+		}
+		if cfg.TrustedFile != "" {
+			trusted, err := loadTrustedRanges(cfg.TrustedFile)
+			if err != nil {
+				return nil, fmt.Errorf("读取地区 %s 的可信网段失败: %w", country, err)
+			}
+			policy.trusted = trusted
+		}
+		policies[country] = policy
+	}
+	return policies, nil
+}
+
+// check 单个IP或网段不符合规则的原因，符合时返回空
+func (p *ipPolicy) check(entry string) string {
+	prefix, err := parseEntryPrefix(entry)
+	if err != nil {
+		return "格式错误"
+	}
+
+	for _, deny := range p.deny {
+		if deny.Overlaps(prefix) {
+			return fmt.Sprintf("在禁止列表 %s 中", deny)
+		}
+	}
+	for _, trusted := range p.trusted {
+		if prefixCovers(trusted, prefix) {
+			return ""
+		}
+	}
+
+	for _, r := range policyRanges {
+		if !r.enabled(p.PolicyConfig) {
+			continue
+		}
+		for _, reserved := range r.prefixes {
+			if reserved.Overlaps(prefix) {
+				return fmt.Sprintf("%s %s", r.reason, reserved)
+			}
+		}
+	}
+
+	minBits := p.MinPrefixV6
+	if prefix.Addr().Is4() {
+		minBits = p.MinPrefixV4
+	}
+	if prefix.Bits() < minBits {
+		return fmt.Sprintf("网段过大，前缀长度不能小于 /%d", minBits)
+	}
+	return ""
+}
+
+// checkIPPolicy 按地区规则校验换行分隔的IP列表，返回每个被拒绝IP的原因
+func checkIPPolicy(country, ipList string) error {
+	policy, ok := ipPolicies[country]
+	if !ok {
+		policy, ok = ipPolicies["default"]
+	}
+	if !ok {
+		return nil
+	}
+
+	rejections := make([]policyRejection, 0)
+	for _, ip := range splitIPs(ipList) {
+		if reason := policy.check(ip); reason != "" {
+			rejections = append(rejections, policyRejection{IP: ip, Reason: reason})
+		}
+	}
+	if len(rejections) > 0 {
+		return &policyError{Rejections: rejections}
+	}
+	return nil
+}
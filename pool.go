@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 请求由固定数量的 worker 处理，远程命令的并发槽位，先占服务器槽位再占全局槽位，等待服务器时不占用全局槽位
+var (
+	globalSlots chan struct{}
+	serverSlots = make(map[string]chan struct{})
+	muSlots     sync.Mutex
+)
+
+// initWorkerPool 按配置创建全局槽位并启动处理请求的 worker
+func initWorkerPool() {
+	globalSlots = make(chan struct{}, AppConfig.Queue.MaxSessions)
+	for i := 0; i < AppConfig.Queue.Workers; i++ {
+		go runWorker()
+	}
+}
+
+// enqueueRequest 请求加入商户队列，商户空闲时交给 worker 处理
+func enqueueRequest(req Request) {
+	key := merchantKey{req.WhiteList.MerchantName, req.WhiteList.Country}
+	mu.Lock()
+	defer mu.Unlock()
+
+	if req.ID == 0 {
+		req.ID, req.QueuedAt = nextRequestID(), time.Now()
+	}
+	merchantQueue[key] = append(merchantQueue[key], req)
+	if !processing[key] {
+		processing[key] = true
+		readyKeys = append(readyKeys, key)
+		workReady.Signal()
+	}
+}
+
+// runWorker 依次处理就绪商户的队首请求，处理期间商户一直标记为 processing，保证同一商户按队列顺序执行
+func runWorker() {
+	for {
+		mu.Lock()
+		for len(readyKeys) == 0 {
+			workReady.Wait()
+		}
+		key := readyKeys[0]
+		readyKeys = readyKeys[1:]
+		if len(merchantQueue[key]) == 0 {
+			// 等待期间请求都被取消
+			delete(processing, key)
+			delete(merchantQueue, key)
+			mu.Unlock()
+			continue
+		}
+		req := merchantQueue[key][0]
+		merchantQueue[key] = merchantQueue[key][1:]
+		mu.Unlock()
+
+		status, err := modifyMerchant(req)
+		finishSubJob(req.JobID, key, status, err)
+		req.finish(status, err)
+
+		// 还有等待的请求时排到就绪队列末尾，让其他商户也能被处理
+		mu.Lock()
+		if len(merchantQueue[key]) > 0 {
+			readyKeys = append(readyKeys, key)
+			workReady.Signal()
+		} else {
+			delete(processing, key)
+			delete(merchantQueue, key)
+		}
+		mu.Unlock()
+	}
+}
+
+// serverSessionLimit 服务器同时执行的远程命令数
+func serverSessionLimit(server string) int {
+	limit, ok := AppConfig.Queue.ServerSessions[server]
+	if !ok {
+		limit = AppConfig.Queue.ServerSessions["default"]
+	}
+	if limit <= 0 {
+		return AppConfig.Queue.MaxSessions
+	}
+	return limit
+}
+
+// serverSlot 服务器的槽位，首次使用时创建
+func serverSlot(server string) chan struct{} {
+	muSlots.Lock()
+	defer muSlots.Unlock()
+
+	slot, ok := serverSlots[server]
+	if !ok {
+		slot = make(chan struct{}, serverSessionLimit(server))
+		serverSlots[server] = slot
+	}
+	return slot
+}
+
+// acquireSession 等待可用的槽位，返回释放函数
+func acquireSession(server string) func() {
+	slot := serverSlot(server)
+	slot <- struct{}{}
+	globalSlots <- struct{}{}
+	return func() {
+		<-globalSlots
+		<-slot
+	}
+}
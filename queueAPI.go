@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// requestSeq 队列中请求编号的序号
+var requestSeq uint64
+
+// nextRequestID 分配请求编号
+func nextRequestID() uint64 {
+	return atomic.AddUint64(&requestSeq, 1)
+}
+
+// queuedRequest 队列中等待的请求
+type queuedRequest struct {
+	ID           uint64    `json:"id"`
+	MerchantName string    `json:"merchantName"`
+	Country      string    `json:"country"`
+	Action       string    `json:"action"`
+	IPs          []string  `json:"ips"`
+	OpUser       string    `json:"opUser"`
+	Source       string    `json:"source"`
+	QueuedAt     time.Time `json:"queuedAt"`
+	Age          int       `json:"age"` // 已等待的秒数
+	Position     int       `json:"position"`
+}
+
+// merchantQueueInfo 商户在某个地区的处理状态与等待的请求
+type merchantQueueInfo struct {
+	MerchantName string          `json:"merchantName"`
+	Country      string          `json:"country"`
+	Processing   bool            `json:"processing"`
+	Requests     []queuedRequest `json:"requests"`
+}
+
+// queueBody 取消或调整请求的参数
+type queueBody struct {
+	MerchantName string `json:"merchantName" binding:"required"`
+	Country      string `json:"country" binding:"required"`
+	ID           uint64 `json:"id" binding:"required"`
+	OpUser       string `json:"opUser" binding:"required"`
+}
+
+// isQueueAdmin 用户是否可以管理他人的请求
+func isQueueAdmin(username string) bool {
+	var user User
+	if err := DB.Where("username = ?", username).Limit(1).Find(&user).Error; err != nil || user.ID == 0 {
+		return false
+	}
+	return contains(AppConfig.Queue.AdminRoles, user.Role)
+}
+
+// key 请求所在的队列
+func (b queueBody) key() merchantKey {
+	return merchantKey{b.MerchantName, b.Country}
+}
+
+// queueIndex 请求在商户队列中的位置，调用方需持有 mu
+func queueIndex(key merchantKey, id uint64) int {
+	for i, req := range merchantQueue[key] {
+		if req.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// queueSnapshot 各商户的队列，可按商户过滤
+func queueSnapshot(merchantName string) []merchantQueueInfo {
+	mu.Lock()
+	defer mu.Unlock()
+
+	keys := make([]merchantKey, 0, len(processing))
+	for key := range processing {
+		if merchantName == "" || key.MerchantName == merchantName {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].MerchantName != keys[j].MerchantName {
+			return keys[i].MerchantName < keys[j].MerchantName
+		}
+		return keys[i].Country < keys[j].Country
+	})
+
+	now := time.Now()
+	infos := make([]merchantQueueInfo, 0, len(keys))
+	for _, key := range keys {
+		info := merchantQueueInfo{MerchantName: key.MerchantName, Country: key.Country, Processing: processing[key], Requests: make([]queuedRequest, 0)}
+		for i, req := range merchantQueue[key] {
+			info.Requests = append(info.Requests, queuedRequest{
+				ID:           req.ID,
+				MerchantName: key.MerchantName,
+				Country:      req.WhiteList.Country,
+				Action:       req.Action,
+				IPs:          splitIPs(req.WhiteList.IP),
+				OpUser:       req.WhiteList.OpUser,
+				Source:       req.Source,
+				QueuedAt:     req.QueuedAt,
+				Age:          int(now.Sub(req.QueuedAt).Seconds()),
+				Position:     i + 1,
+			})
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// queueList 商户队列，可按 merchantName 过滤
+func queueList(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": queueSnapshot(c.DefaultQuery("merchantName", ""))})
+}
+
+// queueCancel 取消等待中的请求，提交人或管理员可以取消
+func queueCancel(c *gin.Context) {
+	var body queueBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "格式错误"})
+		return
+	}
+	admin := isQueueAdmin(body.OpUser)
+
+	mu.Lock()
+	i := queueIndex(body.key(), body.ID)
+	if i < 0 {
+		mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "请求不存在或已开始处理"})
+		return
+	}
+	queue := merchantQueue[body.key()]
+	req := queue[i]
+	if req.WhiteList.OpUser != body.OpUser && !admin {
+		mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "只能取消自己提交的请求"})
+		return
+	}
+	merchantQueue[body.key()] = append(queue[:i:i], queue[i+1:]...)
+	mu.Unlock()
+
+	reason := fmt.Errorf("已被 %s 取消", body.OpUser)
+	recordAttempt(req.newLog(body.MerchantName), LogStatusCancelled, reason)
+	finishSubJob(req.JobID, body.key(), LogStatusCancelled, reason)
+	req.finish(LogStatusCancelled, reason)
+	req.replyEvent(NotifyEvent{
+		Type:     EventJobCancelled,
+		Country:  req.WhiteList.Country,
+		Merchant: body.MerchantName,
+		IPs:      splitIPs(req.WhiteList.IP),
+		Action:   req.Action,
+		OpUser:   req.WhiteList.OpUser,
+		Error:    reason.Error(),
+	})
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "message": "已取消"})
+}
+
+// queuePrioritize 管理员将请求移到队首
+func queuePrioritize(c *gin.Context) {
+	var body queueBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "格式错误"})
+		return
+	}
+	if !isQueueAdmin(body.OpUser) {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "没有调整优先级的权限"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	i := queueIndex(body.key(), body.ID)
+	if i < 0 {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "请求不存在或已开始处理"})
+		return
+	}
+	queue := merchantQueue[body.key()]
+	req := queue[i]
+	copy(queue[1:i+1], queue[:i])
+	queue[0] = req
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "message": "已移到队首"})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// quotaUsage 商户的配额使用情况
+type quotaUsage struct {
+	MerchantName string `json:"merchantName"`
+	Country      string `json:"country"`
+	Count        int    `json:"count"`
+	Quota        int    `json:"quota"`   // 0 表示不限制
+	Percent      int    `json:"percent"` // 不限制时为 0
+}
+
+// merchantQuota 商户的条目上限，商户配置优先，其次地区，最后 default
+func merchantQuota(merchantName, country string) int {
+	cfg := AppConfig.Quota
+	if quota, ok := cfg.Merchants[merchantName]; ok {
+		return quota
+	}
+	if quota, ok := cfg.Regions[country]; ok {
+		return quota
+	}
+	return cfg.Regions["default"]
+}
+
+// quotaPercent 使用量占配额的百分比
+func quotaPercent(count, quota int) int {
+	if quota <= 0 {
+		return 0
+	}
+	return count * 100 / quota
+}
+
+// checkQuota 变更后的条目数是否超出配额
+func checkQuota(merchantName, country, ipList string) error {
+	quota := merchantQuota(merchantName, country)
+	if count := len(splitIPs(ipList)); quota > 0 && count > quota {
+		return fmt.Errorf("商户 %s 的白名单条目数 %d 超出配额 %d", merchantName, count, quota)
+	}
+	return nil
+}
+
+// warnQuota 条目数从阈值以下增加到阈值以上时提醒
+func warnQuota(merchantName, country, beforeIPs, afterIPs string) {
+	quota := merchantQuota(merchantName, country)
+	if quota <= 0 {
+		return
+	}
+
+	warn := AppConfig.Quota.WarnPercent
+	before, after := len(splitIPs(beforeIPs)), len(splitIPs(afterIPs))
+	if quotaPercent(before, quota) < warn && quotaPercent(after, quota) >= warn {
+		notify(NotifyEvent{
+			Type:     EventQuotaWarning,
+			Country:  country,
+			Merchant: merchantName,
+			Count:    after,
+			Quota:    quota,
+			Percent:  quotaPercent(after, quota),
+		})
+	}
+}
+
+// whitelistQuota 各商户的条目数与配额，可按 country、merchantName 过滤
+func whitelistQuota(c *gin.Context) {
+	query := DB.Order("country, merchant_name")
+	if country := c.DefaultQuery("country", ""); country != "" {
+		query = query.Where("country = ?", country)
+	}
+	if merchantName := c.DefaultQuery("merchantName", ""); merchantName != "" {
+		query = query.Where("merchant_name = ?", merchantName)
+	}
+
+	var whiteLists []WhiteList
+	if err := query.Find(&whiteLists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+
+	usages := make([]quotaUsage, 0, len(whiteLists))
+	for _, whiteList := range whiteLists {
+		usage := quotaUsage{
+			MerchantName: whiteList.MerchantName,
+			Country:      whiteList.Country,
+			Count:        len(splitIPs(whiteList.IP)),
+			Quota:        merchantQuota(whiteList.MerchantName, whiteList.Country),
+		}
+		usage.Percent = quotaPercent(usage.Count, usage.Quota)
+		usages = append(usages, usage)
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": usages})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// 远程执行的步骤，对应重试配置的键
+const (
+	StepIngress  = "ingress"
+	StepCrontask = "bsicrontask"
+)
+
+// transientOutputs ssh 连接失败时的输出，出现时可以重试
+var transientOutputs = []string{
+	"connection refused",
+	"connection reset",
+	"connection timed out",
+	"connection closed",
+	"no route to host",
+	"network is unreachable",
+	"kex_exchange_identification",
+	"temporary failure in name resolution",
+}
+
+// retryPolicy 步骤的重试配置
+func retryPolicy(step string) RetryPolicy {
+	policy, ok := AppConfig.Retry[step]
+	if !ok {
+		policy, ok = AppConfig.Retry["default"]
+	}
+	if !ok || policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return policy
+}
+
+// delay 第 attempt 次执行失败后等待的时间
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	seconds := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && seconds > float64(p.MaxDelay) {
+		seconds = float64(p.MaxDelay)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// isRetryable 超时、ssh 连接失败（退出码 255）可以重试，命令本身的错误不重试
+func isRetryable(result commandResult, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errCommandTimeout) || result.ExitCode == 255 {
+		return true
+	}
+	output := strings.ToLower(result.Output)
+	for _, s := range transientOutputs {
+		if strings.Contains(output, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// executeWithRetry 按步骤的重试配置执行远程命令，返回每次执行的结果
+func executeWithRetry(step, server, command string) ([]commandResult, error) {
+	policy := retryPolicy(step)
+	results := make([]commandResult, 0, policy.MaxAttempts)
+	for attempt := 1; ; attempt++ {
+		// 服务器熔断后不再重试
+		if !serverAvailable(server) {
+			return results, fmt.Errorf("%w: %s", errServerDown, server)
+		}
+
+		result, err := executeSSHCommand(server, command)
+		result.Step, result.Attempt = step, attempt
+		results = append(results, result)
+		recordServerResult(server, result, err)
+		if err == nil {
+			return results, nil
+		}
+
+		if !isRetryable(result, err) {
+			return results, err
+		}
+		if attempt >= policy.MaxAttempts {
+			if errors.Is(err, errCommandTimeout) {
+				notify(NotifyEvent{Type: EventCommandTimeout, Server: server, Count: attempt})
+			}
+			if attempt > 1 {
+				err = fmt.Errorf("重试 %d 次后仍失败: %w", attempt-1, err)
+			}
+			return results, err
+		}
+
+		wait := policy.delay(attempt)
+		log.Printf("%s 第 %d 次执行失败，%s 后重试: %v", step, attempt, wait, err)
+		time.Sleep(wait)
+	}
+}
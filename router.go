@@ -14,18 +14,69 @@ func SetupRoutes(router *gin.Engine) {
 		user.DELETE("/delete", userDelete)
 		user.GET("/list", userList)
 		user.POST("/reset", userReset)
+		user.POST("/lark", userLarkBind)
 	}
 
 	// 白名单路由组
 	whiteList := router.Group("/api/whitelist")
 	{
+		whiteList.GET("/list", whitelistList)
 		whiteList.POST("/add", whitelistAdd)
 		whiteList.DELETE("/delete", whitelistDelete)
+		whiteList.GET("/export", whitelistExport)
+		whiteList.POST("/import", whitelistImport)
+		whiteList.POST("/import/confirm", whitelistImportConfirm)
+		whiteList.GET("/quota", whitelistQuota)
+		whiteList.GET("/approvals", whitelistApprovals)
+		whiteList.POST("/approvals/approve", whitelistApprove)
+		whiteList.POST("/approvals/reject", whitelistReject)
+		whiteList.GET("/jobs", whitelistJobs)
+		whiteList.GET("/scheduled", whitelistScheduled)
+		whiteList.POST("/scheduled/cancel", whitelistScheduledCancel)
+		whiteList.GET("/versions", whitelistVersions)
+		whiteList.GET("/versions/diff", whitelistVersionDiff)
+		whiteList.POST("/versions/restore", whitelistVersionRestore)
 	}
 
 	// 白名单日志路由组
 	whiteListLog := router.Group("/api/whitelistlog")
 	{
 		whiteListLog.GET("/list", whitelistLogList)
+		whiteListLog.GET("/export", whitelistLogExport)
+		whiteListLog.GET("/verify", whitelistLogVerify)
+		whiteListLog.POST("/verify", whitelistLogVerify)
+		whiteListLog.POST("/retry", whitelistLogRetry)
+	}
+
+	// 处理队列路由组
+	queue := router.Group("/api/queue")
+	{
+		queue.GET("/list", queueList)
+		queue.POST("/cancel", queueCancel)
+		queue.POST("/prioritize", queuePrioritize)
+	}
+
+	// 服务器状态路由组
+	server := router.Group("/api/server")
+	{
+		server.GET("/status", serverStatus)
+	}
+
+	// 统计路由组
+	stats := router.Group("/api/stats")
+	{
+		stats.GET("/ips", statsIPCount)
+		stats.GET("/changes", statsChanges)
+		stats.GET("/operators", statsOperators)
+		stats.GET("/failures", statsFailures)
+		stats.GET("/churn", statsChurn)
+		stats.GET("/stale", statsStale)
+		stats.GET("/activity", statsActivity)
+	}
+
+	// Lark 事件订阅
+	lark := router.Group("/api/lark")
+	{
+		lark.POST("/event", larkEvent)
 	}
 }
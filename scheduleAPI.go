@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+// errScheduled 请求已保存为计划变更，不立即执行
+var errScheduled = errors.New("已计划执行")
+
+// minutes 时段的开始和结束，从零点起的分钟数
+func (w TimeWindow) minutes() (start, end int, err error) {
+	s, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("开始时间 %q 格式错误", w.Start)
+	}
+	e, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("结束时间 %q 格式错误", w.End)
+	}
+	return s.Hour()*60 + s.Minute(), e.Hour()*60 + e.Minute(), nil
+}
+
+// onWeekday 时段是否在某天开始
+func (w TimeWindow) onWeekday(day time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range w.Weekdays {
+		if time.Weekday(d) == day {
+			return true
+		}
+	}
+	return false
+}
+
+// contains 时间是否在时段内，包含开始不包含结束
+func (w TimeWindow) contains(t time.Time) bool {
+	start, end, err := w.minutes()
+	if err != nil {
+		return false
+	}
+	t = t.In(time.Local)
+	minute := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return w.onWeekday(t.Weekday()) && minute >= start && minute < end
+	}
+
+	// 跨零点，零点后属于前一天开始的时段
+	if minute >= start {
+		return w.onWeekday(t.Weekday())
+	}
+	return minute < end && w.onWeekday((t.Weekday()+6)%7)
+}
+
+// changeAllowed 地区当前是否允许变更，不允许时返回原因
+func changeAllowed(country string, t time.Time) (bool, string) {
+	schedule, ok := AppConfig.Schedule[country]
+	if !ok {
+		schedule = AppConfig.Schedule["default"]
+	}
+
+	for _, blackout := range schedule.Blackouts {
+		if blackout.contains(t) {
+			return false, "处于禁止变更时段"
+		}
+	}
+	if len(schedule.Windows) == 0 {
+		return true, ""
+	}
+	for _, window := range schedule.Windows {
+		if window.contains(t) {
+			return true, ""
+		}
+	}
+	return false, "不在维护窗口内"
+}
+
+// holdChange 保存计划变更
+func holdChange(req Request, at time.Time, reason string) (ScheduledChange, error) {
+	change := ScheduledChange{
+		MerchantName: req.WhiteList.MerchantName,
+		Country:      req.WhiteList.Country,
+		IP:           req.WhiteList.IP,
+		Action:       req.Action,
+		OpUser:       req.WhiteList.OpUser,
+		Collapse:     req.WhiteList.Collapse,
+		Source:       req.Source,
+		ClientIP:     req.ClientIP,
+		ScheduledAt:  at,
+		Status:       ScheduledPending,
+		Reason:       reason,
+		Metas:        req.Metas,
+	}
+	return change, DB.Create(&change).Error
+}
+
+// request 计划变更对应的请求
+func (s ScheduledChange) request() Request {
+	return Request{
+		WhiteList: WhiteList{MerchantName: s.MerchantName, Country: s.Country, IP: s.IP, OpUser: s.OpUser, Collapse: s.Collapse},
+		Action:    s.Action,
+		Source:    s.Source,
+		ClientIP:  s.ClientIP,
+		Metas:     s.Metas,
+		HeldAt:    s.CreatedAt,
+	}
+}
+
+// targetsAllowed 请求涉及的地区是否都允许变更
+func targetsAllowed(targets []merchantKey, t time.Time) (bool, string) {
+	for _, target := range targets {
+		if allowed, reason := changeAllowed(target.Country, t); !allowed {
+			return false, fmt.Sprintf("地区 %s %s", target.Country, reason)
+		}
+	}
+	return true, ""
+}
+
+// holdIfNotAllowed 任一地区不在允许变更的时段时挂起整个请求，返回是否已挂起
+func holdIfNotAllowed(req Request, targets []merchantKey) bool {
+	allowed, reason := targetsAllowed(targets, time.Now())
+	if allowed {
+		return false
+	}
+
+	change, err := holdChange(req, time.Now(), reason)
+	if err != nil {
+		log.Printf("挂起变更失败: %v", err)
+		recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusFailed, fmt.Errorf("%s, 挂起失败: %w", reason, err))
+		return true
+	}
+	recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusPending, fmt.Errorf("%s, 已挂起为计划变更 %d", reason, change.ID))
+	req.replyEvent(NotifyEvent{
+		Type:     EventChangeHeld,
+		Country:  req.WhiteList.Country,
+		Merchant: req.WhiteList.MerchantName,
+		IPs:      splitIPs(req.WhiteList.IP),
+		Action:   req.Action,
+		OpUser:   req.WhiteList.OpUser,
+		Error:    reason,
+	})
+	return true
+}
+
+// runDueChanges 执行到期且处于允许时段的计划变更
+func runDueChanges() {
+	now := time.Now()
+	var changes []ScheduledChange
+	if err := DB.Where("status = ? AND scheduled_at <= ?", ScheduledPending, now).Order("scheduled_at, id").Find(&changes).Error; err != nil {
+		log.Printf("查询计划变更失败: %v", err)
+		return
+	}
+
+	requests := make([]Request, 0, len(changes))
+	for _, change := range changes {
+		// 地区无效时交给 whitelistModify 记录失败
+		if targets, err := requestTargets(change.request().WhiteList); err == nil {
+			if allowed, _ := targetsAllowed(targets, now); !allowed {
+				continue
+			}
+		}
+		result := DB.Model(&ScheduledChange{}).Where("id = ? AND status = ?", change.ID, ScheduledPending).Update("status", ScheduledDone)
+		if result.Error != nil {
+			log.Printf("更新计划变更 %d 失败: %v", change.ID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 1 {
+			requests = append(requests, change.request())
+		}
+	}
+
+	// 按计划时间顺序进入队列
+	go func() {
+		for _, req := range requests {
+			whitelistModify(req)
+		}
+	}()
+}
+
+// runScheduledChanges 每分钟检查计划变更
+func runScheduledChanges() {
+	for range time.Tick(time.Minute) {
+		runDueChanges()
+	}
+}
+
+// whitelistScheduled 计划变更列表，可按 status 过滤
+func whitelistScheduled(c *gin.Context) {
+	query := DB.Order("scheduled_at DESC, id DESC")
+	if status := c.DefaultQuery("status", ""); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var changes []ScheduledChange
+	if err := query.Find(&changes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": changes})
+}
+
+// whitelistScheduledCancel 取消未执行的计划变更，提交人或管理员可以取消
+func whitelistScheduledCancel(c *gin.Context) {
+	var body struct {
+		ID     uint   `json:"id" binding:"required"`
+		OpUser string `json:"opUser" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "格式错误"})
+		return
+	}
+
+	var change ScheduledChange
+	if err := DB.Where("id = ? AND status = ?", body.ID, ScheduledPending).Limit(1).Find(&change).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	if change.ID == 0 {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "计划变更不存在或已执行"})
+		return
+	}
+	// 与取消队列中的请求相同，提交人或管理员可以取消
+	if change.OpUser != body.OpUser && !isQueueAdmin(body.OpUser) {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "只能取消自己提交的计划变更"})
+		return
+	}
+
+	result := DB.Model(&ScheduledChange{}).Where("id = ? AND status = ?", body.ID, ScheduledPending).
+		Updates(map[string]interface{}{"status": ScheduledCancelled, "cancelled_by": body.OpUser})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "计划变更不存在或已执行"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "message": "已取消"})
+}
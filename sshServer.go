@@ -2,26 +2,52 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os/exec"
 	"time"
 )
 
-// ssh到服务器执行命令，5秒超时
-func executeSSHCommand(server, command string) error {
+// errCommandTimeout 远程命令执行超时
+var errCommandTimeout = errors.New("command timed out")
+
+// commandResult 远程命令的执行结果
+type commandResult struct {
+	Server   string
+	Command  string
+	ExitCode int // 超时或未能执行时为 -1
+	Output   string
+	Step     string // 执行的步骤: ingress/bsicrontask
+	Attempt  int    // 第几次执行，从 1 开始
+}
+
+// ssh到服务器执行命令，30秒超时，超时从拿到槽位后开始计算
+func executeSSHCommand(server, command string) (commandResult, error) {
+	release := acquireSession(server)
+	defer release()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	result := commandResult{Server: server, Command: command, ExitCode: -1}
+
 	cmd := exec.CommandContext(ctx, "ssh", "-p", "10086", "root@"+server, command)
 	log.Println("Executing command: ", cmd.String())
 	output, err := cmd.CombinedOutput()
+	result.Output = string(output)
 	if ctx.Err() == context.DeadlineExceeded {
-		SendToLark("执行命令超时！" + fmt.Sprintf("服务器：%s", server))
-		return fmt.Errorf("command timed out")
+		return result, errCommandTimeout
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err == nil {
+		result.ExitCode = 0
 	}
 	if err != nil {
-		return fmt.Errorf("failed to execute command: %s, output: %s, error: %w", command, output, err)
+		return result, fmt.Errorf("failed to execute command: %s, output: %s, error: %w", command, output, err)
 	}
-	return nil
+	return result, nil
 }
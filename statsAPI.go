@@ -0,0 +1,293 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsDefaultDays 未指定 startTime 时统计最近的天数
+const statsDefaultDays = 30
+
+// ipCountStat 商户的IP数量
+type ipCountStat struct {
+	MerchantName string `json:"merchantName"`
+	Country      string `json:"country"`
+	Count        int    `json:"count"`
+}
+
+// dailyChangeStat 每天各操作的次数
+type dailyChangeStat struct {
+	Day   string `json:"day"`
+	Act   string `json:"act"`
+	Count int64  `json:"count"`
+}
+
+// operatorStat 操作人的操作次数
+type operatorStat struct {
+	OpUser string `json:"opUser"`
+	Count  int64  `json:"count"`
+}
+
+// failureStat 各地区的失败率
+type failureStat struct {
+	Country string  `json:"country"`
+	Total   int64   `json:"total"`
+	Failed  int64   `json:"failed"`
+	Rate    float64 `json:"rate"`
+}
+
+// churnStat 商户的变更次数和变更IP数
+type churnStat struct {
+	MerchantName string `json:"merchantName"`
+	Country      string `json:"country"`
+	Changes      int    `json:"changes"`
+	ChangedIPs   int    `json:"changedIPs"`
+}
+
+// staleStat 长时间未变更的IP，LastAdded 为空表示没有添加记录
+type staleStat struct {
+	MerchantName string     `json:"merchantName"`
+	Country      string     `json:"country"`
+	IP           string     `json:"ip"`
+	LastAdded    *time.Time `json:"lastAdded"`
+}
+
+// splitIPs 换行分隔的IP列表
+func splitIPs(ipList string) []string {
+	ips := make([]string, 0)
+	for _, ip := range strings.Split(ipList, "\n") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// statsLimit 排行类统计返回的条数
+func statsLimit(c *gin.Context) int {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 {
+		return 10
+	}
+	return limit
+}
+
+// statsLogQuery 解析日志统计的条件，与日志列表相同，默认统计最近 30 天
+func statsLogQuery(c *gin.Context) (logQuery, bool) {
+	q, err := parseLogQuery(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": err.Error()})
+		return q, false
+	}
+	if q.Start.IsZero() {
+		q.Start = time.Now().AddDate(0, 0, -statsDefaultDays)
+	}
+	if err := q.resolve(DB); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return q, false
+	}
+	return q, true
+}
+
+// statsIPCount 每个商户的IP数量，可按 country 过滤
+func statsIPCount(c *gin.Context) {
+	var whiteLists []WhiteList
+	query := DB.Order("country, merchant_name")
+	if country := c.DefaultQuery("country", ""); country != "" {
+		query = query.Where("country = ?", country)
+	}
+	if err := query.Find(&whiteLists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+
+	stats := make([]ipCountStat, 0, len(whiteLists))
+	for _, whiteList := range whiteLists {
+		stats = append(stats, ipCountStat{MerchantName: whiteList.MerchantName, Country: whiteList.Country, Count: len(splitIPs(whiteList.IP))})
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": stats})
+}
+
+// statsChanges 每天各操作的次数
+func statsChanges(c *gin.Context) {
+	q, ok := statsLogQuery(c)
+	if !ok {
+		return
+	}
+
+	// created_at 按上海时区保存，前 10 位即为日期
+	stats := make([]dailyChangeStat, 0)
+	err := DB.Table("whitelist_logs").Select("substr(created_at, 1, 10) AS day, act, COUNT(*) AS count").
+		Scopes(q.where).Where("deleted_at IS NULL").Group("day, act").Order("day, act").Scan(&stats).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": stats})
+}
+
+// statsOperators 操作次数最多的操作人
+func statsOperators(c *gin.Context) {
+	q, ok := statsLogQuery(c)
+	if !ok {
+		return
+	}
+
+	stats := make([]operatorStat, 0)
+	err := DB.Table("whitelist_logs").Select("op_user, COUNT(*) AS count").
+		Scopes(q.where).Where("deleted_at IS NULL").Group("op_user").Order("count DESC, op_user").Limit(statsLimit(c)).Scan(&stats).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": stats})
+}
+
+// statsFailures 各地区的失败率，回滚也计为失败
+func statsFailures(c *gin.Context) {
+	q, ok := statsLogQuery(c)
+	if !ok {
+		return
+	}
+
+	stats := make([]failureStat, 0)
+	err := DB.Table("whitelist_logs").
+		Select("country, COUNT(*) AS total, SUM(CASE WHEN status IN ? THEN 1 ELSE 0 END) AS failed", []string{LogStatusFailed, LogStatusRolledBack}).
+		Scopes(q.where).Where("deleted_at IS NULL").Group("country").Order("country").Scan(&stats).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	for i := range stats {
+		if stats[i].Total > 0 {
+			stats[i].Rate = float64(stats[i].Failed) / float64(stats[i].Total)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": stats})
+}
+
+// statsChurn 成功变更次数最多的商户
+func statsChurn(c *gin.Context) {
+	q, ok := statsLogQuery(c)
+	if !ok {
+		return
+	}
+
+	var rows []WhitelistLog
+	err := DB.Select("merchant_name, country, changed_ips").Scopes(q.where).
+		Where("status = ?", LogStatusSuccess).Find(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+
+	index := make(map[string]int)
+	stats := make([]churnStat, 0)
+	for _, row := range rows {
+		key := row.MerchantName + "|" + row.Country
+		i, ok := index[key]
+		if !ok {
+			i = len(stats)
+			index[key] = i
+			stats = append(stats, churnStat{MerchantName: row.MerchantName, Country: row.Country})
+		}
+		stats[i].Changes++
+		stats[i].ChangedIPs += len(splitIPs(row.ChangedIPs))
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].Changes != stats[j].Changes {
+			return stats[i].Changes > stats[j].Changes
+		}
+		return stats[i].ChangedIPs > stats[j].ChangedIPs
+	})
+	if limit := statsLimit(c); len(stats) > limit {
+		stats = stats[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": stats})
+}
+
+// statsStale 超过 days 天（默认 90）未重新添加的IP，包含归档的日志
+func statsStale(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "90"))
+	if err != nil || days < 1 {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "days 格式错误"})
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	// 每个IP最后一次成功添加的时间
+	lastAdded := make(map[string]time.Time)
+	record := func(l WhitelistLog) error {
+		if l.Act != "add" || l.Status != LogStatusSuccess {
+			return nil
+		}
+		for _, ip := range splitIPs(l.ChangedIPs) {
+			key := l.MerchantName + "|" + ip
+			if l.CreatedAt.After(lastAdded[key]) {
+				lastAdded[key] = l.CreatedAt
+			}
+		}
+		return nil
+	}
+	if err := scanArchives(record); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	var rows []WhitelistLog
+	if err := DB.Select("merchant_name, act, status, changed_ips, created_at").Where("act = ? AND status = ?", "add", LogStatusSuccess).Find(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	for _, row := range rows {
+		_ = record(row)
+	}
+
+	var whiteLists []WhiteList
+	query := DB.Order("country, merchant_name")
+	if country := c.DefaultQuery("country", ""); country != "" {
+		query = query.Where("country = ?", country)
+	}
+	if err := query.Find(&whiteLists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+
+	stats := make([]staleStat, 0)
+	for _, whiteList := range whiteLists {
+		for _, ip := range splitIPs(whiteList.IP) {
+			stat := staleStat{MerchantName: whiteList.MerchantName, Country: whiteList.Country, IP: ip}
+			if t, ok := lastAdded[whiteList.MerchantName+"|"+ip]; ok {
+				if t.After(cutoff) {
+					continue
+				}
+				stat.LastAdded = &t
+			}
+			stats = append(stats, stat)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": stats})
+}
+
+// statsActivity 各用户某天的操作汇总和异常，date 默认当天
+func statsActivity(c *gin.Context) {
+	day := time.Now()
+	if date := c.DefaultQuery("date", ""); date != "" {
+		var err error
+		if day, err = time.ParseInLocation("2006-01-02", date, time.Local); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "date 格式错误"})
+			return
+		}
+	}
+
+	reports, err := activityReport(day, c.DefaultQuery("opUser", ""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": reports})
+}
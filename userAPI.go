@@ -215,3 +215,70 @@ func userList(c *gin.Context) {
 		},
 	})
 }
+
+// userLarkBind 绑定 Lark 账号
+func userLarkBind(c *gin.Context) {
+	username := c.PostForm("username")
+	if username == "" {
+		c.JSON(http.StatusOK, gin.H{"code": 40001, "message": "用户名不能为空"})
+		return
+	}
+
+	// 只更新请求中提供的字段，单独切换私信时保留已绑定的账号
+	updates := make(map[string]interface{})
+	if openID, ok := c.GetPostForm("larkOpenId"); ok {
+		updates["lark_open_id"] = openID
+	}
+	if email, ok := c.GetPostForm("larkEmail"); ok {
+		updates["lark_email"] = email
+	}
+	if dm, ok := c.GetPostForm("larkDM"); ok {
+		updates["lark_dm"] = dm == "true"
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusOK, gin.H{"code": 40001, "message": "没有要更新的字段"})
+		return
+	}
+
+	var user User
+	if err := DB.Where("username = ?", username).Limit(1).Find(&user).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40002, "message": "绑定失败", "detail": err.Error()})
+		return
+	}
+	if user.ID == 0 {
+		c.JSON(http.StatusOK, gin.H{"code": 40001, "message": "用户不存在"})
+		return
+	}
+	// 绑定后可以通过机器人修改白名单，需验证用户本人的密码或管理员的账号密码
+	if !larkBindAllowed(c, user) {
+		c.JSON(http.StatusOK, gin.H{"code": 40001, "message": "账号密码错误或没有绑定权限"})
+		return
+	}
+
+	if err := DB.Model(&User{}).Where("username = ?", username).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40002, "message": "绑定失败", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    20000,
+		"message": "绑定成功",
+	})
+}
+
+// larkBindAllowed 提供了用户本人的密码，或提供了管理员的账号密码
+func larkBindAllowed(c *gin.Context, user User) bool {
+	if password := c.PostForm("password"); password != "" && user.CheckPassword(password, user.PasswordHash) {
+		return true
+	}
+
+	opUser, opPassword := c.PostForm("opUser"), c.PostForm("opPassword")
+	if opUser == "" || opPassword == "" {
+		return false
+	}
+	var admin User
+	if err := DB.Where("username = ?", opUser).Limit(1).Find(&admin).Error; err != nil || admin.ID == 0 {
+		return false
+	}
+	return admin.Role == "admin" && admin.CheckPassword(opPassword, admin.PasswordHash)
+}
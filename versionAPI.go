@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// saveWhitelistVersion 保存变更后的快照，商户第一次记录时先保存变更前的IP作为基线
+func saveWhitelistVersion(tx *gorm.DB, whitelistLog WhitelistLog) error {
+	var last, regional WhitelistVersion
+	if err := tx.Where("merchant_name = ?", whitelistLog.MerchantName).Order("version DESC").Limit(1).Find(&last).Error; err != nil {
+		return err
+	}
+	// 版本号按商户递增，基线按地区记录
+	if err := tx.Where("merchant_name = ? AND country = ?", whitelistLog.MerchantName, whitelistLog.Country).Limit(1).Find(&regional).Error; err != nil {
+		return err
+	}
+
+	if regional.ID == 0 && strings.TrimSpace(whitelistLog.BeforeIPs) != "" {
+		last = WhitelistVersion{
+			MerchantName: whitelistLog.MerchantName,
+			Version:      last.Version + 1,
+			Country:      whitelistLog.Country,
+			IP:           whitelistLog.BeforeIPs,
+			Act:          "baseline",
+		}
+		if err := tx.Create(&last).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Create(&WhitelistVersion{
+		MerchantName: whitelistLog.MerchantName,
+		Version:      last.Version + 1,
+		Country:      whitelistLog.Country,
+		IP:           whitelistLog.AfterIPs,
+		Act:          whitelistLog.Act,
+		ChangedIPs:   whitelistLog.ChangedIPs,
+		OpUser:       whitelistLog.OpUser,
+		LogID:        whitelistLog.ID,
+	}).Error
+}
+
+// findWhitelistVersion 查询商户的某个版本
+func findWhitelistVersion(merchantName, version string) (WhitelistVersion, error) {
+	var v WhitelistVersion
+	number, err := strconv.Atoi(version)
+	if err != nil {
+		return v, fmt.Errorf("版本号格式错误: %s", version)
+	}
+	err = DB.Where("merchant_name = ? AND version = ?", merchantName, number).First(&v).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return v, fmt.Errorf("商户 %s 不存在版本 %d", merchantName, number)
+	}
+	return v, err
+}
+
+// diffIPs 从 from 到 to 新增和删除的IP
+func diffIPs(from, to string) (added, removed []string) {
+	fromIPs, toIPs := splitIPs(from), splitIPs(to)
+	added, removed = make([]string, 0), make([]string, 0)
+	for _, ip := range toIPs {
+		if !contains(fromIPs, ip) {
+			added = append(added, ip)
+		}
+	}
+	for _, ip := range fromIPs {
+		if !contains(toIPs, ip) {
+			removed = append(removed, ip)
+		}
+	}
+	return added, removed
+}
+
+// whitelistVersions 商户的版本列表，按版本号倒序
+func whitelistVersions(c *gin.Context) {
+	merchantName := c.DefaultQuery("merchantName", "")
+	if merchantName == "" {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "商户不能为空"})
+		return
+	}
+
+	var versions []WhitelistVersion
+	if err := DB.Where("merchant_name = ?", merchantName).Order("version DESC").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": versions})
+}
+
+// whitelistVersionDiff 对比商户的两个版本
+func whitelistVersionDiff(c *gin.Context) {
+	merchantName := c.DefaultQuery("merchantName", "")
+	from, err := findWhitelistVersion(merchantName, c.DefaultQuery("from", ""))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": err.Error()})
+		return
+	}
+	to, err := findWhitelistVersion(merchantName, c.DefaultQuery("to", ""))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": err.Error()})
+		return
+	}
+
+	added, removed := diffIPs(from.IP, to.IP)
+	c.JSON(http.StatusOK, gin.H{
+		"code": 20000,
+		"data": gin.H{
+			"from":    from,
+			"to":      to,
+			"added":   added,
+			"removed": removed,
+		},
+	})
+}
+
+// whitelistVersionRestore 将商户恢复到指定版本，先删除多出的IP再添加缺少的IP，均通过正常队列执行
+func whitelistVersionRestore(c *gin.Context) {
+	var body struct {
+		MerchantName string `json:"merchantName" binding:"required"`
+		Version      int    `json:"version" binding:"required"`
+		OpUser       string `json:"opUser"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "格式错误"})
+		return
+	}
+	if body.OpUser == "" {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": "您未登录，权限被拒绝"})
+		return
+	}
+
+	target, err := findWhitelistVersion(body.MerchantName, strconv.Itoa(body.Version))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": err.Error()})
+		return
+	}
+
+	// 恢复版本所在地区的IP列表
+	var current WhiteList
+	if err := DB.Where("merchant_name = ? AND country = ?", body.MerchantName, target.Country).Limit(1).Find(&current).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	country := target.Country
+
+	added, removed := diffIPs(current.IP, target.IP)
+	if len(added) == 0 && len(removed) == 0 {
+		c.JSON(http.StatusOK, gin.H{"code": 40000, "message": fmt.Sprintf("当前IP列表与版本 %d 相同", target.Version)})
+		return
+	}
+
+	// 恢复的IP按添加相同的规则校验，当前规则禁止的IP不能通过恢复加回
+	if len(added) > 0 {
+		restored := WhiteList{MerchantName: body.MerchantName, Country: country, IP: strings.Join(added, "\n"), OpUser: body.OpUser}
+		err := ValidateWhiteListIPs(restored)
+		if err == nil {
+			err = checkIPPolicy(country, restored.IP)
+		}
+		if err == nil {
+			err = checkGeo(restored)
+		}
+		if err != nil {
+			recordAttempt(Request{WhiteList: restored, Action: "add", Source: SourceRestore, ClientIP: c.ClientIP()}.newLog(body.MerchantName), LogStatusFailed, err)
+			response := gin.H{"code": 40000, "message": fmt.Sprintf("无法恢复到版本 %d: %v", target.Version, err)}
+			var policy *policyError
+			if errors.As(err, &policy) {
+				response["rejected"] = policy.Rejections
+			}
+			c.JSON(http.StatusOK, response)
+			return
+		}
+	}
+
+	requests := make([]Request, 0, 2)
+	for _, change := range []struct {
+		action string
+		ips    []string
+	}{{"del", removed}, {"add", added}} {
+		if len(change.ips) == 0 {
+			continue
+		}
+		requests = append(requests, Request{
+			// 恢复的网段可能包含当前的条目，直接合并
+			WhiteList: WhiteList{MerchantName: body.MerchantName, Country: country, IP: strings.Join(change.ips, "\n"), OpUser: body.OpUser, Collapse: true},
+			Action:    change.action,
+			Source:    SourceRestore,
+			ClientIP:  c.ClientIP(),
+		})
+	}
+
+	// 按顺序进入队列，保证先删除后添加
+	go func() {
+		for _, req := range requests {
+			whitelistModify(req)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    20000,
+		"message": fmt.Sprintf("正在恢复到版本 %d，删除 %d 个IP，添加 %d 个IP，请稍后查看结果", target.Version, len(removed), len(added)),
+		"data":    gin.H{"added": added, "removed": removed},
+	})
+}
@@ -16,34 +16,83 @@ import (
 type Request struct {
 	WhiteList WhiteList
 	Action    string
+	Source    string                         // 请求来源: ui/api/chat
+	ClientIP  string                         // 请求方的IP
+	Reply     func(message string)           // 操作结果回调，如在 Lark 会话中回复
+	ID        uint64                         // 进入队列时分配的请求编号
+	QueuedAt  time.Time                      // 进入队列的时间
+	JobID     uint                           // 多商户请求的父任务，单商户请求为 0
+	Metas     []importMeta                   // 导入的备注和过期时间，添加成功后保存
+	Done      func(status string, err error) // 处理结束的回调，挂起为计划变更时状态为 pending
+	HeldAt    time.Time                      // 由计划变更执行时为提交的时间
+	RetryOf   uint                           // 重试时为原操作的日志
 }
 
-var (
-	merchantQueue = make(map[string][]Request)
-	processing    = make(map[string]bool)
-	mu            sync.Mutex
-	larkChannel   = make(chan string)     // 用于发送 Lark 消息的通道
-	larkSent      = make(map[string]bool) // 记录是否已发送过 Lark 消息
-	muLarkSent    sync.Mutex              // 保护 larkSent 的互斥锁
-)
+// newLog 构造本次请求在某个商户上的操作日志
+func (r Request) newLog(merchantName string) WhitelistLog {
+	return WhitelistLog{
+		MerchantName: merchantName,
+		IP:           r.WhiteList.IP,
+		Act:          r.Action,
+		OpUser:       r.WhiteList.OpUser,
+		Country:      r.WhiteList.Country,
+		Source:       r.Source,
+		ClientIP:     r.ClientIP,
+		RetryOf:      r.RetryOf,
+	}
+}
 
-func processNextRequest(merchantName string) {
-	mu.Lock()
-	defer mu.Unlock()
+// recordAttempt 记录未成功的操作
+func recordAttempt(whitelistLog WhitelistLog, status string, err error) {
+	whitelistLog.Status = status
+	if err != nil {
+		whitelistLog.Message = err.Error()
+	}
+	if err := createWhitelistLog(DB, &whitelistLog); err != nil {
+		log.Printf("记录操作日志失败: %v", err)
+	}
+}
 
-	if len(merchantQueue[merchantName]) == 0 {
-		delete(processing, merchantName)
+// finish 回调请求的处理结果
+func (r Request) finish(status string, err error) {
+	if r.Done != nil {
+		r.Done(status, err)
+	}
+}
+
+// replyEvent 回报通知事件
+func (r Request) replyEvent(event NotifyEvent) {
+	if r.Reply == nil {
 		return
 	}
+	message, err := renderNotify(event, AppConfig.Lark.App.Locale, event.OpUser)
+	if err != nil {
+		log.Printf("渲染通知失败: %v", err)
+		return
+	}
+	r.Reply(message)
+}
 
-	req := merchantQueue[merchantName][0]
-	merchantQueue[merchantName] = merchantQueue[merchantName][1:]
+// CountryAll 请求的地区为商户已存在的所有地区
+const CountryAll = "all"
 
-	go func() {
-		whitelistModify(req.WhiteList, req.Action)
-	}()
+// merchantKey 队列按商户和地区区分，同一商户不同地区的变更互不阻塞
+type merchantKey struct {
+	MerchantName string
+	Country      string
 }
 
+var (
+	merchantQueue = make(map[merchantKey][]Request)
+	processing    = make(map[merchantKey]bool) // 队列中有请求或正在处理的商户
+	readyKeys     []merchantKey                // 等待 worker 处理的商户，同一商户同时只出现一次
+	mu            sync.Mutex
+	workReady     = sync.NewCond(&mu)
+	larkChannel   = make(chan NotifyEvent) // 用于发送 Lark 消息的通道
+	larkSent      = make(map[string]bool)  // 记录是否已发送过 Lark 消息
+	muLarkSent    sync.Mutex               // 保护 larkSent 的互斥锁
+)
+
 // 对比ip是否在列表中
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
@@ -54,10 +103,50 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
-// processIPs IP地址格式处理与检查是否存在
+// collapseError 新增的网段包含已有的条目，需要确认合并
+type collapseError struct {
+	Entry   string
+	Covered []string
+}
+
+func (e *collapseError) Error() string {
+	return fmt.Sprintf("网段 %s 包含已有的 %s，确认合并请设置 collapse", e.Entry, strings.Join(e.Covered, ","))
+}
+
+// normalizeEntry 网段统一为掩码后的形式，单个IP保持原样
+func normalizeEntry(entry string) string {
+	entry = strings.TrimSpace(entry)
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		return prefix.Masked().String()
+	}
+	return entry
+}
+
+// entryPrefix 按地区聚合后的网段，单个IP视为 /32 或 /128
+func entryPrefix(entry, country string) (netip.Prefix, error) {
+	masked, err := applyMaskToIPv6Single(entry, country)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix, err := netip.ParsePrefix(masked); err == nil {
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(masked)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// prefixCovers a 是否包含 b
+func prefixCovers(a, b netip.Prefix) bool {
+	return a.Bits() <= b.Bits() && a.Contains(b.Addr())
+}
+
+// processIPs IP地址格式处理与检查是否存在，网段按包含关系判断重复
 func processIPs(whiteList WhiteList, merchantName string, action string) (string, []string, bool, error) {
 	var existingWhiteList WhiteList
-	if err := DB.Where("merchant_name = ?", merchantName).First(&existingWhiteList).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+	if err := DB.Where("merchant_name = ? AND country = ?", merchantName, whiteList.Country).First(&existingWhiteList).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		return "", nil, false, fmt.Errorf("查询数据库失败: %w", err)
 	}
 
@@ -67,88 +156,127 @@ func processIPs(whiteList WhiteList, merchantName string, action string) (string
 	failedIPs := make([]string, 0)
 	validNewIPs := make([]string, 0)
 
-	// 将 currentIPs 转换为 /48 前缀
-	maskedCurrentIPs := make([]string, 0, len(currentIPs))
-	for _, ip := range currentIPs {
-		maskedIP, err := applyMaskToIPv6Single(ip)
+	// 将 currentIPs 转换为聚合后的网段，与 currentIPs 一一对应
+	maskedCurrentIPs := make([]netip.Prefix, len(currentIPs))
+	for i, ip := range currentIPs {
+		if strings.TrimSpace(ip) == "" {
+			continue
+		}
+		prefix, err := entryPrefix(ip, whiteList.Country)
 		if err != nil {
-			log.Printf("转换当前IP %s 为 /48 前缀失败: %v", ip, err)
+			log.Printf("转换当前IP %s 为聚合前缀失败: %v", ip, err)
 			continue // 忽略转换失败的IP
 		}
-		maskedCurrentIPs = append(maskedCurrentIPs, maskedIP)
+		maskedCurrentIPs[i] = prefix
 	}
 
 	// 关键修改：在函数开始处声明 newIPList
 	var newIPList string
 
 	if action == "add" {
+		covered := make(map[int]bool) // 被新网段包含的已有条目
+		validPrefixes := make([]netip.Prefix, 0)
 		for _, newIP := range newIPs {
-			newIP = strings.TrimSpace(newIP)
-			maskedNewIP, err := applyMaskToIPv6Single(newIP) // 将新IP转换为 /48 前缀
+			newIP = normalizeEntry(newIP)
+			prefix, err := entryPrefix(newIP, whiteList.Country) // 按地区配置的前缀聚合
 			if err != nil {
-				log.Printf("转换新IP %s 为 /48 前缀失败: %v", newIP, err)
+				log.Printf("转换新IP %s 为聚合前缀失败: %v", newIP, err)
 				failedIPs = append(failedIPs, newIP) //转换失败的IP加入到失败列表
 				continue
 			}
-			if contains(maskedCurrentIPs, maskedNewIP) { // 使用转换后的前缀进行比较
+
+			// 已有条目或本次的其他条目包含该IP即为重复
+			duplicate := false
+			for _, p := range append(maskedCurrentIPs, validPrefixes...) {
+				if p.IsValid() && prefixCovers(p, prefix) {
+					duplicate = true
+					break
+				}
+			}
+			if duplicate {
 				failedIPs = append(failedIPs, newIP)
 				continue
 			}
+
+			coveredIPs := make([]string, 0)
+			for i, p := range maskedCurrentIPs {
+				if p.IsValid() && prefixCovers(prefix, p) {
+					covered[i] = true
+					coveredIPs = append(coveredIPs, strings.TrimSpace(currentIPs[i]))
+				}
+			}
+			if len(coveredIPs) > 0 && !whiteList.Collapse {
+				return "", nil, false, &collapseError{Entry: newIP, Covered: coveredIPs}
+			}
 			validNewIPs = append(validNewIPs, newIP)
+			validPrefixes = append(validPrefixes, prefix)
 		}
 
 		if len(validNewIPs) > 0 {
 			if existingWhiteList.IP == "" {
 				newIPList = strings.Join(validNewIPs, "\n")
 			} else {
-				combinedIPs := append(currentIPs, validNewIPs...)
+				// 合并时去掉被新网段包含的条目
+				combinedIPs := make([]string, 0, len(currentIPs)+len(validNewIPs))
+				for i, ip := range currentIPs {
+					if !covered[i] {
+						combinedIPs = append(combinedIPs, ip)
+					}
+				}
+				combinedIPs = append(combinedIPs, validNewIPs...)
 				uniqueIPs := removeDuplicateValues(combinedIPs)
 				newIPList = strings.Join(uniqueIPs, "\n")
 			}
 		}
+		// 超出配额时整个请求不执行
+		if err := checkQuota(merchantName, whiteList.Country, newIPList); err != nil {
+			return "", nil, false, err
+		}
 		if len(failedIPs) > 0 {
-			message := fmt.Sprintf("%s 商户 %s 的 IP %s 已存在 操作用户: %s", whiteList.Country, merchantName, strings.Join(failedIPs, ","), whiteList.OpUser)
-			sendLarkMessage(message)
+			sendLarkMessage(NotifyEvent{Type: EventIPDuplicate, Country: whiteList.Country, Merchant: merchantName, IPs: failedIPs, Action: action, OpUser: whiteList.OpUser})
 		}
 
 	} else if action == "del" {
+		deletePrefixes := make([]netip.Prefix, 0)
 		for _, newIP := range newIPs {
-			newIP = strings.TrimSpace(newIP)
-			maskedNewIP, err := applyMaskToIPv6Single(newIP)
+			newIP = normalizeEntry(newIP)
+			prefix, err := entryPrefix(newIP, whiteList.Country)
 			if err != nil {
-				log.Printf("转换要删除的IP %s 为 /48 前缀失败: %v", newIP, err)
+				log.Printf("转换要删除的IP %s 为聚合前缀失败: %v", newIP, err)
 				failedIPs = append(failedIPs, newIP) //转换失败的IP加入到失败列表
 				continue
 			}
 
-			if !contains(maskedCurrentIPs, maskedNewIP) { // 使用转换后的前缀进行比较
+			found := false
+			for _, p := range maskedCurrentIPs {
+				if p == prefix {
+					found = true
+					break
+				}
+			}
+			if !found { // 使用聚合后的网段进行比较
 				failedIPs = append(failedIPs, newIP)
 				continue
 			}
 			validNewIPs = append(validNewIPs, newIP)
+			deletePrefixes = append(deletePrefixes, prefix)
 		}
 		if len(failedIPs) > 0 {
-			message := fmt.Sprintf("%s 商户 %s 的 IP %s 不存在，无法删除 操作用户: %s", whiteList.Country, merchantName, strings.Join(failedIPs, ","), whiteList.OpUser)
-			sendLarkMessage(message)
+			sendLarkMessage(NotifyEvent{Type: EventIPMissing, Country: whiteList.Country, Merchant: merchantName, IPs: failedIPs, Action: action, OpUser: whiteList.OpUser})
 		}
 
-		// 正确地使用 /48 前缀构建 remainingIPs 列表
+		// 使用聚合后的网段构建 remainingIPs 列表
 		remainingIPs := make([]string, 0, len(currentIPs))
-		for _, currentIP := range currentIPs {
-			maskedCurrentIP, err := applyMaskToIPv6Single(currentIP)
-			if err != nil {
-				log.Printf("转换数据库中IP %s 为 /48 前缀失败: %v", currentIP, err)
-				remainingIPs = append(remainingIPs, currentIP) //转换失败也保留
+		for i, currentIP := range currentIPs {
+			if !maskedCurrentIPs[i].IsValid() {
+				if strings.TrimSpace(currentIP) != "" {
+					remainingIPs = append(remainingIPs, currentIP) //转换失败也保留
+				}
 				continue
 			}
 			shouldKeep := true
-			for _, ipToDelete := range validNewIPs {
-				maskedIPToDelete, err := applyMaskToIPv6Single(ipToDelete)
-				if err != nil {
-					log.Printf("转换要删除的IP %s 为 /48 前缀失败: %v", ipToDelete, err)
-					continue
-				}
-				if maskedCurrentIP == maskedIPToDelete {
+			for _, prefix := range deletePrefixes {
+				if maskedCurrentIPs[i] == prefix {
 					shouldKeep = false
 					break
 				}
@@ -178,10 +306,11 @@ func processIPs(whiteList WhiteList, merchantName string, action string) (string
 }
 
 // sendLarkMessage 发送Lark消息的函数，包含去重逻辑
-func sendLarkMessage(message string) {
+func sendLarkMessage(event NotifyEvent) {
+	message := fmt.Sprintf("%v", event)
 	muLarkSent.Lock()
 	if _, ok := larkSent[message]; !ok {
-		larkChannel <- message
+		larkChannel <- event
 		larkSent[message] = true
 		go func() {
 			time.Sleep(1000 * time.Millisecond)
@@ -193,49 +322,117 @@ func sendLarkMessage(message string) {
 	muLarkSent.Unlock()
 }
 
-// applyMaskToIPv6Single 单个ip转换/48
-func applyMaskToIPv6Single(ipStr string) (string, error) {
+// aggregationPrefix 地区的IP聚合前缀长度，未配置时使用 default
+func aggregationPrefix(country string) (ipv6, ipv4 int) {
+	prefix, ok := AppConfig.Aggregation[country]
+	if !ok {
+		prefix = AppConfig.Aggregation["default"]
+	}
+	ipv6, ipv4 = prefix.IPv6, prefix.IPv4
+	if ipv6 == 0 {
+		ipv6 = 48
+	}
+	if ipv4 == 0 {
+		ipv4 = 32
+	}
+	return ipv6, ipv4
+}
+
+// applyMaskToIPv6Single 按地区配置的前缀聚合单个IP或网段，IPv6 默认 /48，IPv4 默认不聚合，比聚合前缀更大的网段保持不变
+func applyMaskToIPv6Single(ipStr, country string) (string, error) {
 	ipStr = strings.TrimSpace(ipStr)
-	//处理ipv6地址包含/的情况
+	bits := -1
+	var ip netip.Addr
 	if strings.Contains(ipStr, "/") {
-		ipStr = strings.Split(ipStr, "/")[0]
-	}
-	if ip, err := netip.ParseAddr(ipStr); err == nil && ip.Is6() {
-		prefix, err := ip.Prefix(48)
+		prefix, err := netip.ParsePrefix(ipStr)
 		if err != nil {
-			return "", fmt.Errorf("Failed to create prefix for %s: %w", ipStr, err)
+			return "", fmt.Errorf("ParsePrefix(%q): %w", ipStr, err)
 		}
-		return prefix.String(), nil
-	} else if err != nil {
-		return "", fmt.Errorf("ParseAddr(%q): %w", ipStr, err) // 包含原始错误信息
+		ip, bits = prefix.Addr(), prefix.Bits()
 	} else {
-		return ipStr, nil // 不是IPv6地址，直接返回
+		var err error
+		if ip, err = netip.ParseAddr(ipStr); err != nil {
+			return "", fmt.Errorf("ParseAddr(%q): %w", ipStr, err) // 包含原始错误信息
+		}
 	}
+
+	ipv6Bits, ipv4Bits := aggregationPrefix(country)
+	aggregate := ipv6Bits
+	if ip.Is4() || ip.Is4In6() {
+		if ip.Is4In6() && bits >= 96 {
+			bits -= 96
+		}
+		ip, aggregate = ip.Unmap(), ipv4Bits
+		if bits < 0 && aggregate == 32 {
+			return ip.String(), nil // 不聚合，4-in-6 地址转换为 IPv4
+		}
+	}
+	if bits < 0 || bits > aggregate {
+		bits = aggregate
+	}
+
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create prefix for %s: %w", ipStr, err)
+	}
+	return prefix.String(), nil
 }
 
-// applyMaskToIPv6 applies a /48 mask to IPv6 addresses in a comma-separated list
-func applyMaskToIPv6(ipList string) string {
+// applyMaskToIPv6 按地区配置的前缀聚合逗号分隔的IP列表，聚合后相同的前缀只保留一个
+func applyMaskToIPv6(ipList, country string) string {
 	ips := strings.Split(ipList, ",")
 	var maskedIPs []string
 
 	for _, ipStr := range ips {
-		maskedIP, err := applyMaskToIPv6Single(ipStr)
+		maskedIP, err := applyMaskToIPv6Single(ipStr, country)
 		if err != nil {
-			log.Printf("转换IP %s 为 /48 前缀失败: %v", ipStr, err)
+			log.Printf("聚合IP %s 失败: %v", ipStr, err)
 			maskedIPs = append(maskedIPs, ipStr) // 保留原始IP，避免丢失数据
 			continue
 		}
 		maskedIPs = append(maskedIPs, maskedIP)
 	}
-	return strings.Join(maskedIPs, ",")
+	return strings.Join(removeDuplicateValues(maskedIPs), ",")
+}
+
+// region 各地区的远程执行配置
+type region struct {
+	Server     string
+	Kubeconfig string
+	Crontask   string // bsicrontask 程序、etcd 地址及配置目录
 }
 
-// 执行远程命令
-func executeRemoteCommand(country, merchantName, ipList string, validNewIPs []string, action string, whiteList WhiteList) error {
+var regions = map[string]region{
+	"br": {
+		Server:     "15.229.106.224",
+		Kubeconfig: "/root/.kube/config",
+		Crontask:   "/data/jenkins/workspace/br-all-server/bsicrontask/bsicrontask 172.31.9.57:2379,172.31.4.34:2379,172.31.9.96:2379 /bs",
+	},
+	"pk": {
+		Server:     "16.162.63.178",
+		Kubeconfig: "/root/.kube/config-kp",
+		Crontask:   "/opt/jenkins/workspace/pk-all-server/bsicrontask/bsicrontask 10.2.32.103:2379,10.2.32.101:2379,10.2.32.102:2379 /pk",
+	},
+	"vn": {
+		Server:     "16.162.63.178",
+		Kubeconfig: "/root/.kube/config",
+		Crontask:   "/opt/jenkins/workspace/vn-all-server/bsicrontask/bsicrontask 10.0.3.102:2379,10.0.3.101:2379,10.0.3.103:2379 /vn",
+	},
+	"ph": {
+		Server:     "18.167.173.173",
+		Kubeconfig: "/root/.kube/config",
+		Crontask:   "/var/lib/jenkins/workspace/php-all-server/bsicrontask/bsicrontask 10.1.3.101:2379,10.1.3.102:2379,10.1.3.103:2379 /ph",
+	},
+}
+
+// errRolledBack 后端加白失败后已将 ingress 恢复为变更前的列表
+var errRolledBack = errors.New("已回滚ingress白名单")
+
+// 执行远程命令，beforeList 为变更前的IP列表，命令2失败时用于回滚ingress
+func executeRemoteCommand(country, merchantName, ipList, beforeList string, validNewIPs []string, action string) ([]commandResult, error) {
 	fmt.Println("商户名：", merchantName)
-	var server, command1, command2, act string
+	var act string
 
-	ipList = strings.ReplaceAll(ipList, "\n", ",")
 	whiteListIP := strings.Join(validNewIPs, ",")
 
 	switch action {
@@ -244,84 +441,131 @@ func executeRemoteCommand(country, merchantName, ipList string, validNewIPs []st
 	case "del":
 		act = "del_ip"
 	default:
-		return fmt.Errorf("错误的操作类型")
-	}
-
-	switch country {
-	case "br":
-		server = "15.229.106.224"
-		command1 = fmt.Sprintf("/opt/script/ingressIpLimit --kubeconfig=/root/.kube/config --namespace=%s --ingressName=admin-%s --iplist=%s", merchantName, merchantName, applyMaskToIPv6(ipList))  // command1 应用掩码
-		command2 = fmt.Sprintf("/data/jenkins/workspace/br-all-server/bsicrontask/bsicrontask 172.31.9.57:2379,172.31.4.34:2379,172.31.9.96:2379 /bs/%s.toml %s %s", merchantName, act, whiteListIP) // command2 不应用掩码
-	case "pk":
-		server = "16.162.63.178"
-		command1 = fmt.Sprintf("/opt/script/ingressIpLimit --kubeconfig=/root/.kube/config-kp --namespace=%s --ingressName=admin-%s --iplist=%s", merchantName, merchantName, applyMaskToIPv6(ipList)) // command1 应用掩码
-		command2 = fmt.Sprintf("/opt/jenkins/workspace/pk-all-server/bsicrontask/bsicrontask 10.2.32.103:2379,10.2.32.101:2379,10.2.32.102:2379 /pk/%s.toml %s %s", merchantName, act, whiteListIP)    // command2 不应用掩码
-	case "vn":
-		server = "16.162.63.178"
-		command1 = fmt.Sprintf("/opt/script/ingressIpLimit --kubeconfig=/root/.kube/config --namespace=%s --ingressName=admin-%s --iplist=%s", merchantName, merchantName, applyMaskToIPv6(ipList)) // command1 应用掩码
-		command2 = fmt.Sprintf("/opt/jenkins/workspace/vn-all-server/bsicrontask/bsicrontask 10.0.3.102:2379,10.0.3.101:2379,10.0.3.103:2379 /vn/%s.toml %s %s", merchantName, act, whiteListIP)    // command2 不应用掩码
-	case "ph":
-		server = "18.167.173.173"
-		command1 = fmt.Sprintf("/opt/script/ingressIpLimit --kubeconfig=/root/.kube/config --namespace=%s --ingressName=admin-%s --iplist=%s", merchantName, merchantName, applyMaskToIPv6(ipList))   // command1 应用掩码
-		command2 = fmt.Sprintf("/var/lib/jenkins/workspace/php-all-server/bsicrontask/bsicrontask 10.1.3.101:2379,10.1.3.102:2379,10.1.3.103:2379 /ph/%s.toml %s %s", merchantName, act, whiteListIP) // command2 不应用掩码
-	default:
-		return fmt.Errorf("错误的国家代码")
+		return nil, fmt.Errorf("错误的操作类型")
+	}
+
+	r, ok := regions[country]
+	if !ok {
+		return nil, fmt.Errorf("错误的国家代码")
+	}
+	// 服务器熔断时暂停，恢复后继续执行
+	waitServer(r.Server)
+
+	// ingressCommand 修改ingress的白名单，应用掩码
+	ingressCommand := func(list string) string {
+		list = strings.ReplaceAll(list, "\n", ",")
+		return fmt.Sprintf("/opt/script/ingressIpLimit --kubeconfig=%s --namespace=%s --ingressName=admin-%s --iplist=%s", r.Kubeconfig, merchantName, merchantName, applyMaskToIPv6(list, country))
 	}
+	command1 := ingressCommand(ipList)
+	command2 := fmt.Sprintf("%s/%s.toml %s %s", r.Crontask, merchantName, act, whiteListIP) // command2 不应用掩码
+
+	results := make([]commandResult, 0)
 
 	// 执行修改ingress的白名单
-	if err := executeSSHCommand(server, command1); err != nil {
-		return fmt.Errorf("执行命令1失败: %w", err)
+	attempts, err := executeWithRetry(StepIngress, r.Server, command1)
+	results = append(results, attempts...)
+	if err != nil {
+		return results, fmt.Errorf("执行命令1失败: %w", err)
 	}
 
 	// 执行后端程序加白
-	if err := executeSSHCommand(server, command2); err != nil {
-		return fmt.Errorf("执行命令2失败: %w", err)
+	attempts, err = executeWithRetry(StepCrontask, r.Server, command2)
+	results = append(results, attempts...)
+	if err != nil {
+		err = fmt.Errorf("执行命令2失败: %w", err)
+		if strings.TrimSpace(beforeList) == "" {
+			return results, err
+		}
+
+		// 回滚ingress，保持与后端一致，服务器熔断时等待恢复后回滚
+		waitServer(r.Server)
+		attempts, rollbackErr := executeWithRetry(StepIngress, r.Server, ingressCommand(beforeList))
+		results = append(results, attempts...)
+		if rollbackErr != nil {
+			return results, fmt.Errorf("%w, 回滚失败: %v", err, rollbackErr)
+		}
+		return results, fmt.Errorf("%w, %w", err, errRolledBack)
 	}
 
-	return nil
+	return results, nil
 }
 
-// 更新数据库并记录日志
-func updateDatabaseAndLog(whiteList WhiteList, merchantName, ipList, action string) error {
+// currentWhitelistIPs 商户在某个地区当前的IP列表
+func currentWhitelistIPs(merchantName, country string) (string, error) {
 	var existingWhiteList WhiteList
-	if err := DB.Where("merchant_name = ?", merchantName).First(&existingWhiteList).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		return err
+	if err := DB.Where("merchant_name = ? AND country = ?", merchantName, country).First(&existingWhiteList).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
 	}
+	return existingWhiteList.IP, nil
+}
 
-	if action == "add" {
-		if existingWhiteList.MerchantName != "" {
-			existingWhiteList.IP = ipList
-			if err := DB.Save(&existingWhiteList).Error; err != nil {
+// 更新数据库并记录日志
+func updateDatabaseAndLog(whiteList WhiteList, merchantName, ipList, action string, whitelistLog WhitelistLog, metas []importMeta) error {
+	muLogChain.Lock()
+	defer muLogChain.Unlock()
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var existingWhiteList WhiteList
+		if err := tx.Where("merchant_name = ? AND country = ?", merchantName, whiteList.Country).First(&existingWhiteList).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if action == "add" {
+			if existingWhiteList.MerchantName != "" {
+				// 合并后被新网段取代的条目不再需要备注和过期时间
+				kept := make(map[string]bool)
+				for _, ip := range splitIPs(ipList) {
+					kept[ip] = true
+				}
+				collapsed := make([]string, 0)
+				for _, ip := range splitIPs(existingWhiteList.IP) {
+					if !kept[ip] {
+						collapsed = append(collapsed, ip)
+					}
+				}
+				if len(collapsed) > 0 {
+					if err := tx.Where("merchant_name = ? AND country = ? AND ip IN ?", merchantName, whiteList.Country, collapsed).Delete(&WhiteListIPMeta{}).Error; err != nil {
+						return err
+					}
+				}
+
+				existingWhiteList.IP = ipList
+				if err := tx.Save(&existingWhiteList).Error; err != nil {
+					return err
+				}
+			} else {
+				newWhiteList := WhiteList{
+					MerchantName: merchantName,
+					IP:           ipList,
+					Country:      whiteList.Country,
+					OpUser:       whiteList.OpUser,
+				}
+				if err := tx.Create(&newWhiteList).Error; err != nil {
+					return err
+				}
+			}
+			if err := saveImportMetas(tx, merchantName, whiteList.Country, whiteList.OpUser, whitelistLog.ChangedIPs, metas); err != nil {
 				return err
 			}
-		} else {
-			newWhiteList := WhiteList{
-				MerchantName: merchantName,
-				IP:           ipList,
-				Country:      whiteList.Country,
-				OpUser:       whiteList.OpUser,
+		} else if action == "del" {
+			existingWhiteList.IP = ipList
+			if err := tx.Save(&existingWhiteList).Error; err != nil {
+				return err
 			}
-			if err := DB.Create(&newWhiteList).Error; err != nil {
+			// 删除IP的备注和过期时间
+			removed := strings.Split(whitelistLog.ChangedIPs, "\n")
+			if err := tx.Where("merchant_name = ? AND country = ? AND ip IN ?", merchantName, whiteList.Country, removed).Delete(&WhiteListIPMeta{}).Error; err != nil {
 				return err
 			}
 		}
-	} else if action == "del" {
-		existingWhiteList.IP = ipList
-		if err := DB.Save(&existingWhiteList).Error; err != nil {
+
+		whitelistLog.Status = LogStatusSuccess
+		whitelistLog.AfterIPs = ipList
+		if err := appendWhitelistLog(tx, &whitelistLog); err != nil {
 			return err
 		}
-	}
-
-	whitelistLog := WhitelistLog{
-		MerchantName: merchantName,
-		IP:           whiteList.IP,
-		Act:          action,
-		OpUser:       whiteList.OpUser,
-		Model: gorm.Model{
-			CreatedAt: time.Now().In(time.Local),
-		},
-	}
-	return DB.Create(&whitelistLog).Error
+		return saveWhitelistVersion(tx, whitelistLog)
+	})
 }
 
 // 去除重复元素
@@ -338,144 +582,329 @@ func removeDuplicateValues(intSlice []string) []string {
 	return list
 }
 
-// validateAndRespond 验证并响应
-func validateAndRespond(c *gin.Context, action string) (WhiteList, error) {
-	var whiteList WhiteList
-	if err := c.ShouldBindJSON(&whiteList); err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"code":    40000,
-			"message": "格式错误",
-		})
-		return whiteList, err
-	}
-
+// validateWhiteList 校验白名单请求
+func validateWhiteList(whiteList WhiteList, action string) error {
 	if whiteList.OpUser == "" {
-		c.JSON(http.StatusOK, gin.H{
-			"code":    40000,
-			"message": "您未登录，权限被拒绝",
-		})
-		return whiteList, fmt.Errorf("未登录")
+		return fmt.Errorf("您未登录，权限被拒绝")
 	}
 
 	// 校验IP地址的格式
-	err := ValidateWhiteListIPs(whiteList)
+	if err := ValidateWhiteListIPs(whiteList); err != nil {
+		return err
+	}
+
+	targets, err := requestTargets(whiteList)
 	if err != nil {
+		return err
+	}
+
+	// 按每个地区分别校验
+	checked := make(map[string]bool)
+	for _, target := range targets {
+		regional := whiteList
+		regional.Country = target.Country
+
+		// 添加时按地区规则校验，删除不受限制
+		if action == "add" && !checked[target.Country] {
+			checked[target.Country] = true
+			if err := checkIPPolicy(regional.Country, regional.IP); err != nil {
+				return err
+			}
+			if err := checkGeo(regional); err != nil {
+				return err
+			}
+		}
+
+		if _, _, _, err := processIPs(regional, target.MerchantName, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestTargets 请求涉及的商户和地区，Country 可以逗号分隔多个地区，all 表示商户已存在的所有地区
+func requestTargets(whiteList WhiteList) ([]merchantKey, error) {
+	targets := make([]merchantKey, 0)
+	seen := make(map[merchantKey]bool)
+	for _, merchantName := range strings.Split(whiteList.MerchantName, ",") {
+		countries := strings.Split(whiteList.Country, ",")
+		if strings.TrimSpace(whiteList.Country) == CountryAll {
+			if err := DB.Model(&WhiteList{}).Where("merchant_name = ?", merchantName).Order("country").Distinct().Pluck("country", &countries).Error; err != nil {
+				return nil, fmt.Errorf("查询商户 %s 的地区失败: %w", merchantName, err)
+			}
+			if len(countries) == 0 {
+				return nil, fmt.Errorf("商户 %s 在所有地区都不存在", merchantName)
+			}
+		}
+
+		for _, country := range countries {
+			country = strings.TrimSpace(country)
+			if _, ok := regions[country]; !ok {
+				return nil, fmt.Errorf("错误的国家代码: %s", country)
+			}
+			key := merchantKey{merchantName, country}
+			if !seen[key] {
+				seen[key] = true
+				targets = append(targets, key)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// actionText 操作类型的中文描述
+func actionText(action string) string {
+	if action == "add" {
+		return "添加"
+	}
+	return "删除"
+}
+
+// requestSource 区分前端和接口调用，接口调用需携带 X-Request-Source: api
+func requestSource(c *gin.Context) string {
+	if c.GetHeader("X-Request-Source") == SourceAPI {
+		return SourceAPI
+	}
+	return SourceUI
+}
+
+// validateAndRespond 验证并响应
+func validateAndRespond(c *gin.Context, action string) (Request, error) {
+	req := Request{Action: action, Source: requestSource(c), ClientIP: c.ClientIP()}
+	if err := c.ShouldBindJSON(&req.WhiteList); err != nil {
+		recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusFailed, fmt.Errorf("格式错误: %w", err))
 		c.JSON(http.StatusOK, gin.H{
 			"code":    40000,
-			"message": err.Error(),
+			"message": "格式错误",
 		})
-		return whiteList, err
+		return req, err
 	}
 
-	var actionText string
-	if action == "add" {
-		actionText = "添加"
-	} else {
-		actionText = "删除"
+	if err := validateWhiteList(req.WhiteList, action); err != nil {
+		// 归属地不一致时提交审批，审批通过后执行
+		var geo *geoMismatchError
+		if errors.As(err, &geo) {
+			approval, approvalErr := requestApproval(req, err.Error())
+			if approvalErr != nil {
+				recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusFailed, fmt.Errorf("%s, 提交审批失败: %w", err.Error(), approvalErr))
+				c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": approvalErr.Error()})
+				return req, approvalErr
+			}
+			recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusPending, fmt.Errorf("%s, 已提交审批 %d", err.Error(), approval.ID))
+			c.JSON(http.StatusOK, gin.H{
+				"code":    20000,
+				"message": fmt.Sprintf("%s，已提交审批", err.Error()),
+				"data":    gin.H{"approvalId": approval.ID},
+			})
+			return req, err
+		}
+
+		recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusFailed, err)
+		response := gin.H{
+			"code":    40000,
+			"message": err.Error(),
+		}
+		// 返回被包含的条目，前端确认后带上 collapse 重新提交
+		var collapse *collapseError
+		if errors.As(err, &collapse) {
+			response["collapse"] = gin.H{"entry": collapse.Entry, "covered": collapse.Covered}
+		}
+		var policy *policyError
+		if errors.As(err, &policy) {
+			response["rejected"] = policy.Rejections
+		}
+		c.JSON(http.StatusOK, response)
+		return req, err
 	}
 
-	// 处理多个商户名
-	merchantNames := strings.Split(whiteList.MerchantName, ",")
-	for _, merchantName := range merchantNames {
-		_, _, _, err := processIPs(whiteList, merchantName, action) // Capture all 4 return values
+	// 指定了未来的执行时间时保存为计划变更
+	if at := req.WhiteList.ScheduledAt; at != nil && at.After(time.Now()) {
+		change, err := holdChange(req, *at, "")
 		if err != nil {
-			c.JSON(http.StatusOK, gin.H{
-				"code":    40000,
-				"message": err.Error(),
-			})
-			return whiteList, err
+			recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusFailed, fmt.Errorf("保存计划变更失败: %w", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+			return req, err
 		}
+		recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusPending, fmt.Errorf("已计划于 %s 执行, 计划变更 %d", at.Local().Format("2006-01-02 15:04"), change.ID))
+		c.JSON(http.StatusOK, gin.H{
+			"code":    20000,
+			"message": fmt.Sprintf("已计划于 %s %s白名单", at.Local().Format("2006-01-02 15:04"), actionText(action)),
+			"data":    gin.H{"scheduledId": change.ID},
+		})
+		return req, errScheduled
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    20000,
-		"message": fmt.Sprintf("正在%s白名单，请稍后查看结果", actionText),
+		"message": fmt.Sprintf("正在%s白名单，请稍后查看结果", actionText(action)),
 	})
-	return whiteList, nil
+	return req, nil
 }
 
-// 添加或删除白名单业务逻辑
-func whitelistModify(whiteList WhiteList, action string) {
-	merchantNames := strings.Split(whiteList.MerchantName, ",")
-	for _, merchantName := range merchantNames {
-		mu.Lock()
-		if processing[merchantName] {
-			merchantQueue[merchantName] = append(merchantQueue[merchantName], Request{WhiteList: whiteList, Action: action})
-			mu.Unlock()
+// 添加或删除白名单业务逻辑，请求进入商户队列由 worker 执行，多个商户或地区拆分为子任务
+func whitelistModify(req Request) {
+	if req.JobID == 0 {
+		targets, err := requestTargets(req.WhiteList)
+		if err != nil {
+			recordAttempt(req.newLog(req.WhiteList.MerchantName), LogStatusFailed, err)
+			req.replyEvent(NotifyEvent{Type: EventJobFailed, Country: req.WhiteList.Country, Merchant: req.WhiteList.MerchantName, Action: req.Action, OpUser: req.WhiteList.OpUser, Error: err.Error()})
+			req.finish(LogStatusFailed, err)
 			return
 		}
-		processing[merchantName] = true
-		mu.Unlock()
-
-		ipList, validNewIPs, hasValidIPs, err := processIPs(whiteList, merchantName, action)
-		if err != nil {
-			log.Printf("处理IP失败: %v", err)
-			mu.Lock()
-			delete(processing, merchantName)
-			mu.Unlock()
-			processNextRequest(merchantName)
+		// 禁止变更时段或维护窗口外的请求挂起，到允许的时段再执行
+		if holdIfNotAllowed(req, targets) {
+			req.finish(ScheduledPending, nil)
 			return
 		}
-
-		if !hasValidIPs {
-			mu.Lock()
-			delete(processing, merchantName)
-			mu.Unlock()
-			processNextRequest(merchantName)
+		if len(targets) > 1 {
+			startMerchantJob(req, targets)
 			return
 		}
+		req.WhiteList.MerchantName, req.WhiteList.Country = targets[0].MerchantName, targets[0].Country
+	}
 
-		resText := ""
-		if action == "add" {
-			resText = "添加"
-		} else {
-			resText = "删除"
-		}
+	enqueueRequest(req)
+}
 
-		err = executeRemoteCommand(whiteList.Country, merchantName, ipList, validNewIPs, action, whiteList)
-		validNewIPsStr := strings.Join(validNewIPs, ",")
-		if err != nil {
-			SendToLark(fmt.Sprintf("%s商户%s 白名单IP %s %s失败! 操作用户: %s", whiteList.Country, merchantName, validNewIPsStr, resText, whiteList.OpUser))
-			mu.Lock()
-			delete(processing, merchantName)
-			mu.Unlock()
-			processNextRequest(merchantName)
-			return
-		} else {
-			// Corrected Lark message construction: use validNewIPs
-			SendToLark(fmt.Sprintf("%s商户%s 白名单IP %s %s成功! 操作用户: %s", whiteList.Country, merchantName, validNewIPsStr, resText, whiteList.OpUser))
-		}
+// modifyMerchant 执行单个商户的变更，返回日志状态
+func modifyMerchant(req Request) (string, error) {
+	whiteList, action := req.WhiteList, req.Action
+	merchantName := whiteList.MerchantName
 
-		err = updateDatabaseAndLog(whiteList, merchantName, ipList, action)
-		if err != nil {
-			log.Printf("更新数据库失败: %v", err)
-			mu.Lock()
-			delete(processing, merchantName)
-			mu.Unlock()
-			processNextRequest(merchantName)
-			return
-		}
+	whitelistLog := req.newLog(merchantName)
+	beforeIPs, err := currentWhitelistIPs(merchantName, whiteList.Country)
+	whitelistLog.BeforeIPs = beforeIPs
+
+	var ipList string
+	var validNewIPs []string
+	var hasValidIPs bool
+	if err == nil {
+		ipList, validNewIPs, hasValidIPs, err = processIPs(whiteList, merchantName, action)
+	}
+	if err != nil {
+		log.Printf("处理IP失败: %v", err)
+		recordAttempt(whitelistLog, LogStatusFailed, err)
+		req.replyEvent(NotifyEvent{Type: EventJobFailed, Country: whiteList.Country, Merchant: merchantName, Action: action, OpUser: whiteList.OpUser, Error: err.Error()})
+		return LogStatusFailed, err
+	}
 
-		mu.Lock()
-		delete(processing, merchantName)
-		mu.Unlock()
+	if !hasValidIPs {
+		recordAttempt(whitelistLog, LogStatusSkipped, nil)
+		req.replyEvent(NotifyEvent{Type: EventIPUnchanged, Country: whiteList.Country, Merchant: merchantName, Action: action, OpUser: whiteList.OpUser})
+		return LogStatusSkipped, nil
+	}
 
-		processNextRequest(merchantName)
+	whitelistLog.ChangedIPs = strings.Join(validNewIPs, "\n")
+	results, err := executeRemoteCommand(whiteList.Country, merchantName, ipList, beforeIPs, validNewIPs, action)
+	whitelistLog.setCommandResults(results)
+	event := NotifyEvent{Country: whiteList.Country, Merchant: merchantName, IPs: validNewIPs, Action: action, OpUser: whiteList.OpUser}
+	if err != nil {
+		status := LogStatusFailed
+		if errors.Is(err, errRolledBack) {
+			status = LogStatusRolledBack
+		}
+		recordAttempt(whitelistLog, status, err)
+		event.Type = EventJobFailed
+		event.Error = err.Error()
+		notify(event)
+		req.replyEvent(event)
+		return status, err
+	}
+
+	event.Type = EventIPAdded
+	if action == "del" {
+		event.Type = EventIPRemoved
+	}
+	notify(event)
+	req.replyEvent(event)
+
+	changedAt := time.Now()
+	if err := updateDatabaseAndLog(whiteList, merchantName, ipList, action, whitelistLog, req.Metas); err != nil {
+		log.Printf("更新数据库失败: %v", err)
+		// 日志随事务回滚，在事务外单独记录本次失败
+		err = fmt.Errorf("远程命令已执行, 更新数据库失败: %w", err)
+		recordAttempt(whitelistLog, LogStatusFailed, err)
+		return LogStatusFailed, err
 	}
+	go checkActivity(whitelistLog, req, changedAt)
+	go warnQuota(merchantName, whiteList.Country, beforeIPs, ipList)
+	if action == "add" {
+		go enrichWhitelistIPs(merchantName, whiteList.Country, whiteList.OpUser, validNewIPs)
+	}
+	return LogStatusSuccess, nil
 }
 
 // 添加白名单入口
 func whitelistAdd(c *gin.Context) {
-	whiteList, err := validateAndRespond(c, "add")
+	req, err := validateAndRespond(c, "add")
 	if err == nil {
-		go whitelistModify(whiteList, "add")
+		go whitelistModify(req)
 	}
 }
 
 // 删除白名单入口
 func whitelistDelete(c *gin.Context) {
-	whiteList, err := validateAndRespond(c, "del")
+	req, err := validateAndRespond(c, "del")
 	if err == nil {
-		go whitelistModify(whiteList, "del")
+		go whitelistModify(req)
+	}
+}
+
+// whitelistEntry 白名单中的单个IP及其备注和归属
+type whitelistEntry struct {
+	IP         string     `json:"ip"`
+	Note       string     `json:"note"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	GeoCountry string     `json:"geoCountry"`
+	ASN        uint       `json:"asn"`
+	ASOrg      string     `json:"asOrg"`
+}
+
+// whitelistList 白名单列表，可按 country、merchantName 过滤，缺少归属信息的IP实时查询并保存
+func whitelistList(c *gin.Context) {
+	query := DB.Order("country, merchant_name")
+	if country := c.DefaultQuery("country", ""); country != "" {
+		query = query.Where("country = ?", country)
+	}
+	if merchantName := c.DefaultQuery("merchantName", ""); merchantName != "" {
+		query = query.Where("merchant_name = ?", merchantName)
+	}
+
+	var whiteLists []WhiteList
+	if err := query.Find(&whiteLists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+
+	// 一次查出所有商户的备注和归属信息
+	merchantNames := make([]string, 0, len(whiteLists))
+	for _, whiteList := range whiteLists {
+		merchantNames = append(merchantNames, whiteList.MerchantName)
+	}
+	var metas []WhiteListIPMeta
+	if err := DB.Where("merchant_name IN ?", merchantNames).Find(&metas).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 50000, "error": err.Error()})
+		return
+	}
+	metaByIP := make(map[string]WhiteListIPMeta, len(metas))
+	for _, meta := range metas {
+		metaByIP[meta.MerchantName+"|"+meta.Country+"|"+meta.IP] = meta
+	}
+
+	data := make([]gin.H, 0, len(whiteLists))
+	for _, whiteList := range whiteLists {
+		entries := make([]whitelistEntry, 0)
+		for _, ip := range splitIPs(whiteList.IP) {
+			meta := metaByIP[whiteList.MerchantName+"|"+whiteList.Country+"|"+ip]
+			entries = append(entries, whitelistEntry{IP: ip, Note: meta.Note, ExpiresAt: meta.ExpiresAt, GeoCountry: meta.GeoCountry, ASN: meta.ASN, ASOrg: meta.ASOrg})
+		}
+
+		data = append(data, gin.H{
+			"merchantName": whiteList.MerchantName,
+			"country":      whiteList.Country,
+			"opUser":       whiteList.OpUser,
+			"entries":      entries,
+		})
 	}
+	c.JSON(http.StatusOK, gin.H{"code": 20000, "data": data})
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var drainOnce sync.Once
+
+// setupTestDB 使用临时数据库，并丢弃测试中产生的通知
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	drainOnce.Do(func() {
+		go func() {
+			for range larkChannel {
+			}
+		}()
+	})
+
+	db := DB
+	if err := openDatabase(filepath.Join(t.TempDir(), "test.db") + "?parseTime=true&loc=Asia%2FShanghai"); err != nil {
+		t.Fatalf("打开数据库失败: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+		DB = db
+	})
+}
+
+// setAggregation 测试期间替换聚合配置
+func setAggregation(t *testing.T) {
+	t.Helper()
+	aggregation := AppConfig.Aggregation
+	AppConfig.Aggregation = map[string]AggregationPrefix{
+		"default": {IPv6: 48, IPv4: 32},
+		"br":      {IPv6: 56, IPv4: 24},
+		"pk":      {IPv6: 64},
+	}
+	t.Cleanup(func() { AppConfig.Aggregation = aggregation })
+}
+
+func TestAggregationPrefix(t *testing.T) {
+	setAggregation(t)
+
+	tests := []struct {
+		country    string
+		ipv6, ipv4 int
+	}{
+		{"br", 56, 24},
+		{"pk", 64, 32}, // 未配置 IPv4 时不聚合
+		{"vn", 48, 32}, // 未配置的地区使用 default
+		{"", 48, 32},
+	}
+	for _, tt := range tests {
+		ipv6, ipv4 := aggregationPrefix(tt.country)
+		if ipv6 != tt.ipv6 || ipv4 != tt.ipv4 {
+			t.Errorf("aggregationPrefix(%q) = %d, %d, 期望 %d, %d", tt.country, ipv6, ipv4, tt.ipv6, tt.ipv4)
+		}
+	}
+}
+
+func TestApplyMaskToIPv6Single(t *testing.T) {
+	setAggregation(t)
+
+	tests := []struct {
+		name    string
+		ip      string
+		country string
+		want    string
+		wantErr bool
+	}{
+		{"IPv6 /56 地区", "2001:db8:1234:5678::1", "br", "2001:db8:1234:5600::/56", false},
+		{"IPv6 /64 地区", "2001:db8:1234:5678:9::1", "pk", "2001:db8:1234:5678::/64", false},
+		{"未知地区使用 default", "2001:db8:1234:5678::1", "xx", "2001:db8:1234::/48", false},
+		{"IPv4 /24 聚合", "1.2.3.4", "br", "1.2.3.0/24", false},
+		{"IPv4 不聚合", "1.2.3.4", "pk", "1.2.3.4", false},
+		{"前后空白", " 1.2.3.4 ", "vn", "1.2.3.4", false},
+		{"4-in-6 按 IPv4 聚合", "::ffff:1.2.3.4", "br", "1.2.3.0/24", false},
+		{"4-in-6 不聚合时转换为 IPv4", "::ffff:1.2.3.4", "vn", "1.2.3.4", false},
+		{"4-in-6 网段", "::ffff:1.2.3.0/120", "vn", "1.2.3.0/24", false},
+		{"IPv4 网段比聚合前缀宽", "1.2.0.0/16", "br", "1.2.0.0/16", false},
+		{"IPv4 网段比聚合前缀窄", "1.2.3.128/25", "br", "1.2.3.0/24", false},
+		{"IPv6 网段比聚合前缀宽", "2001:db8::/32", "br", "2001:db8::/32", false},
+		{"IPv6 网段比聚合前缀窄", "2001:db8:1234:5678::/64", "br", "2001:db8:1234:5600::/56", false},
+		{"网段未对齐时掩码", "1.2.3.4/16", "vn", "1.2.0.0/16", false},
+		{"错误的IP", "1.2.3", "vn", "", true},
+		{"错误的网段", "1.2.3.4/33", "vn", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyMaskToIPv6Single(tt.ip, tt.country)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyMaskToIPv6Single(%q, %q) err = %v, wantErr %v", tt.ip, tt.country, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("applyMaskToIPv6Single(%q, %q) = %q, 期望 %q", tt.ip, tt.country, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyMaskToIPv6(t *testing.T) {
+	setAggregation(t)
+
+	// 聚合后相同的前缀只保留一个
+	got := applyMaskToIPv6("1.2.3.4,1.2.3.5,5.6.7.8", "br")
+	if want := "1.2.3.0/24,5.6.7.0/24"; got != want {
+		t.Errorf("applyMaskToIPv6 = %q, 期望 %q", got, want)
+	}
+}
+
+func TestProcessIPs(t *testing.T) {
+	setAggregation(t)
+
+	tests := []struct {
+		name      string
+		existing  string
+		country   string
+		ip        string
+		action    string
+		collapse  bool
+		wantList  string
+		wantValid []string
+		wantOK    bool
+		wantErr   bool // 期望返回 collapseError
+	}{
+		{
+			name: "新增", existing: "1.2.3.0/24", country: "vn", ip: "5.6.7.8", action: "add",
+			wantList: "1.2.3.0/24\n5.6.7.8", wantValid: []string{"5.6.7.8"}, wantOK: true,
+		},
+		{
+			name: "/32 在已有的 /24 内", existing: "1.2.3.0/24", country: "vn", ip: "1.2.3.4/32", action: "add",
+		},
+		{
+			name: "单个IP在已有的 /24 内", existing: "1.2.3.0/24", country: "vn", ip: "1.2.3.4", action: "add",
+		},
+		{
+			name: "部分重复", existing: "1.2.3.0/24", country: "vn", ip: "1.2.3.4\n5.6.7.8", action: "add",
+			wantList: "1.2.3.0/24\n5.6.7.8", wantValid: []string{"5.6.7.8"}, wantOK: true,
+		},
+		{
+			name: "按地区聚合后重复", existing: "1.2.3.4", country: "br", ip: "1.2.3.200", action: "add",
+		},
+		{
+			name: "IPv6 同一个 /48", existing: "2001:db8:1::1", country: "vn", ip: "2001:db8:1:2::5", action: "add",
+		},
+		{
+			name: "IPv6 /64 地区不同的 /64", existing: "2001:db8:1:1::1", country: "pk", ip: "2001:db8:1:2::1", action: "add",
+			wantList: "2001:db8:1:1::1\n2001:db8:1:2::1", wantValid: []string{"2001:db8:1:2::1"}, wantOK: true,
+		},
+		{
+			name: "更宽的网段未确认合并", existing: "1.2.3.0/24\n5.6.7.8", country: "vn", ip: "1.2.0.0/16", action: "add",
+			wantErr: true,
+		},
+		{
+			name: "更宽的网段确认合并", existing: "1.2.3.0/24\n5.6.7.8", country: "vn", ip: "1.2.0.0/16", action: "add", collapse: true,
+			wantList: "5.6.7.8\n1.2.0.0/16", wantValid: []string{"1.2.0.0/16"}, wantOK: true,
+		},
+		{
+			name: "删除", existing: "1.2.3.0/24\n5.6.7.8", country: "vn", ip: "5.6.7.8", action: "del",
+			wantList: "1.2.3.0/24", wantValid: []string{"5.6.7.8"}, wantOK: true,
+		},
+		{
+			name: "删除不存在的IP", existing: "1.2.3.0/24", country: "vn", ip: "5.6.7.8", action: "del",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			if err := DB.Create(&WhiteList{MerchantName: "m1", Country: tt.country, IP: tt.existing, OpUser: "admin"}).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			whiteList := WhiteList{MerchantName: "m1", Country: tt.country, IP: tt.ip, OpUser: "admin", Collapse: tt.collapse}
+			list, valid, ok, err := processIPs(whiteList, "m1", tt.action)
+			if tt.wantErr {
+				var collapse *collapseError
+				if !errors.As(err, &collapse) {
+					t.Fatalf("err = %v, 期望 collapseError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("processIPs 失败: %v", err)
+			}
+			if list != tt.wantList || ok != tt.wantOK || len(valid) != len(tt.wantValid) {
+				t.Fatalf("processIPs = %q, %v, %v, 期望 %q, %v, %v", list, valid, ok, tt.wantList, tt.wantValid, tt.wantOK)
+			}
+			for i := range valid {
+				if valid[i] != tt.wantValid[i] {
+					t.Errorf("validNewIPs = %v, 期望 %v", valid, tt.wantValid)
+				}
+			}
+		})
+	}
+}
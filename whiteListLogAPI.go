@@ -1,19 +1,43 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 	"net/http"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// logListColumns 列表返回的字段
+const logListColumns = "id, created_at, ip, merchant_name, act, op_user, country, status, changed_ips, before_ips, after_ips, exit_codes, output, message, source, client_ip, retry_of"
+
+// logListItem 列表返回的日志
+type logListItem struct {
+	ID           uint   `json:"id"`
+	CreatedAt    string `json:"created_at"`
+	IP           string `json:"ip"`
+	MerchantName string `json:"merchant_name"`
+	Act          string `json:"act"`
+	OpUser       string `json:"op_user"`
+	Country      string `json:"country"`
+	Status       string `json:"status"`
+	ChangedIPs   string `json:"changed_ips"`
+	BeforeIPs    string `json:"before_ips"`
+	AfterIPs     string `json:"after_ips"`
+	ExitCodes    string `json:"exit_codes"`
+	Output       string `json:"output"`
+	Message      string `json:"message"`
+	Source       string `json:"source"`
+	ClientIP     string `json:"client_ip"`
+	RetryOf      uint   `json:"retry_of"`
+}
+
 func whitelistLogList(c *gin.Context) {
-	var logs []struct {
-		CreatedAt    string `json:"created_at"`
-		IP           string `json:"ip"`
-		MerchantName string `json:"merchant_name"`
-		Act          string `json:"act"`
-		OpUser       string `json:"op_user"`
-	}
+	var logs []logListItem
 
 	// Get pagination parameters from query string
 	page := c.DefaultQuery("page", "1")
@@ -33,24 +57,37 @@ func whitelistLogList(c *gin.Context) {
 	offset := (pageInt - 1) * limitInt
 
 	// Get search parameters from query string
-	ip := c.DefaultQuery("Ip", "")
-	opUser := c.DefaultQuery("OpUser", "")
-	merchantNumber := c.DefaultQuery("MerchantNumber", "")
-
-	// Build the query with pagination and sorting
-	query := DB.Table("whitelist_logs").Select("created_at, ip, merchant_name, act, op_user").Order("created_at DESC").Offset(offset).Limit(limitInt)
-
-	// Add search conditions to the query
-	if ip != "" {
-		query = query.Where("ip LIKE ?", "%"+ip+"%")
+	q, err := parseLogQuery(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": err.Error(),
+		})
+		return
 	}
-	if opUser != "" {
-		query = query.Where("op_user LIKE ?", "%"+opUser+"%")
+	if err := q.resolve(DB); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":  50000,
+			"error": err.Error(),
+		})
+		return
 	}
-	if merchantNumber != "" {
-		query = query.Where("merchant_name LIKE ?", "%"+merchantNumber+"%")
+
+	// 同时查询归档时，数据库取到当前页为止的数据，与归档合并后再分页
+	searchArchive := c.DefaultQuery("archive", "false") == "true"
+	dbOffset, dbLimit := offset, limitInt
+	if searchArchive {
+		if q.Cursor != 0 {
+			offset = 0
+		}
+		dbOffset, dbLimit = 0, offset+limitInt
 	}
 
+	// Build the query with pagination and sorting
+	query := DB.Table("whitelist_logs").Select(logListColumns).Scopes(q.where, q.order, func(db *gorm.DB) *gorm.DB {
+		return q.page(db, dbOffset, dbLimit)
+	})
+
 	// Execute the query
 	if err := query.Scan(&logs).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -62,27 +99,292 @@ func whitelistLogList(c *gin.Context) {
 
 	// Get the total count of filtered logs
 	var total int64
-	countQuery := DB.Table("whitelist_logs")
-	if ip != "" {
-		countQuery = countQuery.Where("ip LIKE ?", "%"+ip+"%")
+	if err := DB.Table("whitelist_logs").Scopes(q.where).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":  50000,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if searchArchive {
+		archived, err := archivedLogItems(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code":  50000,
+				"error": err.Error(),
+			})
+			return
+		}
+		total += int64(len(archived))
+		logs = mergeLogItems(q, logs, archived, offset, limitInt)
+	}
+
+	// 按 created_at 排序时返回下一页的 cursor
+	var nextCursor uint
+	if q.Sort == "created_at" && len(logs) == limitInt {
+		nextCursor = logs[len(logs)-1].ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":       20000,
+		"data":       logs,
+		"total":      total,
+		"nextCursor": nextCursor,
+	})
+}
+
+// newLogListItem 归档日志转换为列表返回的格式
+func newLogListItem(l WhitelistLog) logListItem {
+	return logListItem{
+		ID:           l.ID,
+		CreatedAt:    l.CreatedAt.In(time.Local).Format(time.RFC3339Nano),
+		IP:           l.IP,
+		MerchantName: l.MerchantName,
+		Act:          l.Act,
+		OpUser:       l.OpUser,
+		Country:      l.Country,
+		Status:       l.Status,
+		ChangedIPs:   l.ChangedIPs,
+		BeforeIPs:    l.BeforeIPs,
+		AfterIPs:     l.AfterIPs,
+		ExitCodes:    l.ExitCodes,
+		Output:       l.Output,
+		Message:      l.Message,
+		Source:       l.Source,
+		ClientIP:     l.ClientIP,
+		RetryOf:      l.RetryOf,
+	}
+}
+
+// logItemField 排序字段的值，created_at 与 id 顺序一致，按 id 比较
+func logItemField(item logListItem, field string) string {
+	switch field {
+	case "merchant_name":
+		return item.MerchantName
+	case "op_user":
+		return item.OpUser
+	case "act":
+		return item.Act
+	case "country":
+		return item.Country
+	case "status":
+		return item.Status
+	default:
+		return ""
+	}
+}
+
+// logItemLess 与 logQuery.order 相同的排序
+func logItemLess(q logQuery, a, b logListItem) bool {
+	if va, vb := logItemField(a, q.Sort), logItemField(b, q.Sort); va != vb {
+		return (va < vb) != q.Desc
+	}
+	return (a.ID < b.ID) != q.Desc
+}
+
+// archivedLogs 归档中符合条件的日志，按 logQuery.order 相同的顺序排序
+func archivedLogs(q logQuery) ([]WhitelistLog, error) {
+	logs := make([]WhitelistLog, 0)
+	err := scanArchives(func(l WhitelistLog) error {
+		if q.matches(l) {
+			logs = append(logs, l)
+		}
+		return nil
+	})
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logItemLess(q, newLogListItem(logs[i]), newLogListItem(logs[j]))
+	})
+	return logs, err
+}
+
+// archivedLogItems 归档中符合条件的日志，已排序
+func archivedLogItems(q logQuery) ([]logListItem, error) {
+	logs, err := archivedLogs(q)
+	items := make([]logListItem, 0, len(logs))
+	for _, l := range logs {
+		items = append(items, newLogListItem(l))
+	}
+	return items, err
+}
+
+// mergeLogItems 合并数据库和归档中已排序的日志并分页
+func mergeLogItems(q logQuery, logs, archived []logListItem, offset, limit int) []logListItem {
+	if q.Cursor != 0 {
+		filtered := archived[:0:0]
+		for _, item := range archived {
+			if (q.Desc && item.ID < q.Cursor) || (!q.Desc && item.ID > q.Cursor) {
+				filtered = append(filtered, item)
+			}
+		}
+		archived = filtered
+	}
+
+	merged := make([]logListItem, 0, len(logs)+len(archived))
+	i, j := 0, 0
+	for len(merged) < offset+limit && (i < len(logs) || j < len(archived)) {
+		if j >= len(archived) || (i < len(logs) && logItemLess(q, logs[i], archived[j])) {
+			merged = append(merged, logs[i])
+			i++
+		} else {
+			merged = append(merged, archived[j])
+			j++
+		}
+	}
+	if offset >= len(merged) {
+		return []logListItem{}
+	}
+	return merged[offset:]
+}
+
+// whitelistLogVerify 校验日志哈希链，POST 时可附带签名检查点
+func whitelistLogVerify(c *gin.Context) {
+	report, err := verifyLogChain()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":  50000,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	data := gin.H{"chain": report}
+	if c.Request.Method == http.MethodPost {
+		var checkpoint logCheckpoint
+		if err := c.ShouldBindJSON(&checkpoint); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"code":    40000,
+				"message": "格式错误",
+			})
+			return
+		}
+
+		checkpointResult := gin.H{"valid": true}
+		if err := verifyLogCheckpoint(checkpoint); err != nil {
+			checkpointResult = gin.H{"valid": false, "reason": err.Error()}
+		}
+		data["checkpoint"] = checkpointResult
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 20000,
+		"data": data,
+	})
+}
+
+var (
+	retrying   = make(map[uint]bool) // 正在重试的日志
+	muRetrying sync.Mutex
+)
+
+// whitelistLogRetry 重新执行失败或已回滚的操作，按当前的白名单重新计算变更
+func whitelistLogRetry(c *gin.Context) {
+	var body struct {
+		ID     uint   `json:"id" binding:"required"`
+		OpUser string `json:"opUser" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": "格式错误",
+		})
+		return
+	}
+
+	var failed WhitelistLog
+	if err := DB.Where("id = ? AND status IN ?", body.ID, []string{LogStatusFailed, LogStatusRolledBack}).Limit(1).Find(&failed).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":  50000,
+			"error": err.Error(),
+		})
+		return
 	}
-	if opUser != "" {
-		countQuery = countQuery.Where("op_user LIKE ?", "%"+opUser+"%")
+	if failed.ID == 0 || (failed.Act != "add" && failed.Act != "del") {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": "日志不存在或不是失败的操作",
+		})
+		return
 	}
-	if merchantNumber != "" {
-		countQuery = countQuery.Where("merchant_name LIKE ?", "%"+merchantNumber+"%")
+	// 只重试执行阶段的失败，校验或规则拒绝的请求不能通过重试绕过
+	if failed.ChangedIPs == "" && failed.ExitCodes == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": "该操作未执行远程命令，请修改后重新提交",
+		})
+		return
 	}
-	if err := countQuery.Count(&total).Error; err != nil {
+
+	// 与取消队列中的请求相同，提交人或管理员可以重试
+	if failed.OpUser != body.OpUser && !isQueueAdmin(body.OpUser) {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": "只能重试自己提交的操作",
+		})
+		return
+	}
+
+	// 每条失败的日志只能重试一次，重试再失败时重试新的日志
+	muRetrying.Lock()
+	if retrying[failed.ID] {
+		muRetrying.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": "该操作正在重试",
+		})
+		return
+	}
+	var retried WhitelistLog
+	if err := DB.Select("id").Where("retry_of = ? AND (status IN ? OR exit_codes <> '')", failed.ID, []string{LogStatusSuccess, LogStatusSkipped, LogStatusPending}).Limit(1).Find(&retried).Error; err != nil {
+		muRetrying.Unlock()
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":  50000,
 			"error": err.Error(),
 		})
 		return
 	}
+	if retried.ID != 0 {
+		muRetrying.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"code":    40000,
+			"message": fmt.Sprintf("该操作已重试，请查看日志 %d", retried.ID),
+		})
+		return
+	}
+	retrying[failed.ID] = true
+	muRetrying.Unlock()
+
+	req := Request{
+		WhiteList: WhiteList{MerchantName: failed.MerchantName, Country: failed.Country, IP: failed.IP, OpUser: body.OpUser},
+		Action:    failed.Act,
+		Source:    SourceRetry,
+		ClientIP:  c.ClientIP(),
+		RetryOf:   failed.ID,
+		Done: func(status string, err error) {
+			muRetrying.Lock()
+			delete(retrying, failed.ID)
+			muRetrying.Unlock()
+		},
+	}
+	// 按当前的规则重新校验
+	if err := validateWhiteList(req.WhiteList, req.Action); err != nil {
+		req.finish(LogStatusFailed, err)
+		recordAttempt(req.newLog(failed.MerchantName), LogStatusFailed, err)
+		response := gin.H{
+			"code":    40000,
+			"message": err.Error(),
+		}
+		var policy *policyError
+		if errors.As(err, &policy) {
+			response["rejected"] = policy.Rejections
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
 
+	go whitelistModify(req)
 	c.JSON(http.StatusOK, gin.H{
-		"code":  20000,
-		"data":  logs,
-		"total": total,
+		"code":    20000,
+		"message": fmt.Sprintf("正在重新%s白名单，请稍后查看结果", actionText(failed.Act)),
 	})
 }